@@ -2,12 +2,36 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/Rail-KH/Final_calc/internal/orchestrator"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+
 	app := orchestrator.NewOrchestrator()
+	if len(app.Config.AgentTokens) == 0 {
+		log.Println("AGENT_TOKENS is not set: all agent requests will be rejected")
+	}
+	if len(app.Config.OperatorTokens) == 0 {
+		log.Println("OPERATOR_TOKENS is not set: agents cannot be listed or released from quarantine")
+	}
+	if app.Config.WebhookSecret == "" {
+		log.Println("WEBHOOK_SECRET is not set: webhooks are disabled")
+	}
+
+	if app.Config.Transport == "grpc" {
+		go func() {
+			log.Println("Starting gRPC agent server on port", app.Config.GRPCAddr)
+			if err := app.RunGRPCServer(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	log.Println("Starting Orchestrator on port", app.Config.Addr)
 	if err := app.RunServer(); err != nil {
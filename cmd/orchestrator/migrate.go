@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+	"github.com/Rail-KH/Final_calc/internal/orchestrator"
+)
+
+const migrateUsage = `usage:
+  orchestrator migrate status     list the migrations and when they were applied
+  orchestrator migrate up [N]     apply the pending migrations, up to version N if given`
+
+// migrate runs the migrate subcommand against the database at DATABASE_URL.
+func migrate(args []string) {
+	config := orchestrator.ConfigFromEnv()
+	db, err := database.Connect(config.DatabaseURL, config.DatabaseOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch {
+	case command == "status" && len(args) == 1:
+		states, err := db.MigrationStates(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range states {
+			applied := "pending"
+			if !s.AppliedAt.IsZero() {
+				applied = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d %-24s %s\n", s.Version, s.Name, applied)
+		}
+	case command == "up" && len(args) <= 2:
+		target := 0
+		if len(args) == 2 {
+			if target, err = strconv.Atoi(args[1]); err != nil || target < 1 {
+				log.Fatalf("invalid version %q", args[1])
+			}
+		}
+		applied, err := db.Migrate(ctx, target)
+		for _, m := range applied {
+			fmt.Printf("applied %04d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		version, err := db.Version(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("schema version %d\n", version)
+	default:
+		log.Fatal(migrateUsage)
+	}
+}
@@ -7,14 +7,54 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/agentpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
+// Version is reported to the orchestrator on registration.
+const Version = "1.0.0"
+
+// SupportedOperations lists the operations Calc can evaluate.
+var SupportedOperations = []string{"+", "-", "*", "/"}
+
 type Agent struct {
+	ID              string
 	ComputingPower  int
 	OrchestratorURL string
+	TaskWait        time.Duration
+	BatchSize       int
+	Transport       string
+	GRPCAddr        string
+	Operations      []string
+	Token           string
+
+	client agentpb.AgentServiceClient
+
+	// mu guards ID and secret, which change when the agent registers again.
+	mu     sync.Mutex
+	secret string
+}
+
+type task struct {
+	ID            string  `json:"id"`
+	Arg1          float64 `json:"arg1"`
+	Arg2          float64 `json:"arg2"`
+	Operation     string  `json:"operation"`
+	OperationTime int     `json:"operation_time"`
+}
+
+type taskResult struct {
+	ID     string  `json:"id"`
+	Result float64 `json:"result"`
+	Error  string  `json:"error,omitempty"`
 }
 
 func NewAgent() *Agent {
@@ -26,77 +66,257 @@ func NewAgent() *Agent {
 	if orchestratorURL == "" {
 		orchestratorURL = "http://localhost:8080"
 	}
+	taskWait := 30 * time.Second
+	if v, ok := os.LookupEnv("TASK_WAIT_SECONDS"); ok {
+		if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+			taskWait = time.Duration(sec) * time.Second
+		}
+	}
+	batch, err := strconv.Atoi(os.Getenv("TASK_BATCH_SIZE"))
+	if err != nil || batch < 1 {
+		batch = 2 * cp
+	}
+	transport := os.Getenv("TRANSPORT")
+	if transport == "" {
+		transport = "http"
+	}
+	grpcAddr := os.Getenv("ORCHESTRATOR_GRPC_ADDR")
+	if grpcAddr == "" {
+		grpcAddr = "localhost:5000"
+	}
+	operations := SupportedOperations
+	if v := os.Getenv("OPERATIONS"); v != "" {
+		operations = nil
+		for _, op := range strings.Split(v, ",") {
+			if op = strings.TrimSpace(op); op != "" {
+				operations = append(operations, op)
+			}
+		}
+	}
 	return &Agent{
+		ID:              os.Getenv("AGENT_ID"),
 		ComputingPower:  cp,
 		OrchestratorURL: orchestratorURL,
+		TaskWait:        taskWait,
+		BatchSize:       batch,
+		Transport:       transport,
+		GRPCAddr:        grpcAddr,
+		Operations:      operations,
+		Token:           os.Getenv("AGENT_TOKEN"),
 	}
 }
 
+// Run starts ComputingPower workers fed from a local buffer of at most
+// BatchSize leased tasks. Over HTTP a fetcher fills the buffer and a submitter
+// reports finished results in batches; over gRPC both go through one stream.
 func (a *Agent) Run() {
+	if a.Transport == "grpc" {
+		conn, err := grpc.NewClient(a.GRPCAddr,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithPerRPCCredentials(callCredentials{a}))
+		if err != nil {
+			log.Fatalf("Failed to create gRPC client: %v", err)
+		}
+		defer conn.Close()
+		a.client = agentpb.NewAgentServiceClient(conn)
+	}
+	for {
+		interval, err := a.register()
+		if err == nil {
+			go a.heartbeats(interval)
+			break
+		}
+		log.Printf("Failed to register agent: %v", err)
+		time.Sleep(2 * time.Second)
+	}
+	id, _ := a.identity()
+	log.Printf("Registered as agent %s", id)
+
+	work := make(chan task, a.BatchSize)
+	results := make(chan taskResult, a.BatchSize)
+	slots := make(chan struct{}, a.BatchSize)
+	for i := 0; i < a.BatchSize; i++ {
+		slots <- struct{}{}
+	}
 	for i := 0; i < a.ComputingPower; i++ {
 		log.Printf("Starting worker %d", i)
-		go a.worker(i)
+		go a.worker(i, work, results, slots)
+	}
+	if a.Transport == "grpc" {
+		a.runStream(work, results, slots)
+		return
 	}
-	select {}
+	go a.submitter(results)
+	a.fetcher(work, slots)
+}
+
+// acquireSlots blocks until at least one slot of the local buffer is free and
+// then takes every other free slot without blocking.
+func (a *Agent) acquireSlots(slots chan struct{}) int {
+	<-slots
+	return a.collectSlots(slots, 1)
 }
 
-func (a *Agent) worker(id int) {
+// collectSlots takes free slots without blocking until n reaches BatchSize.
+func (a *Agent) collectSlots(slots chan struct{}, n int) int {
+	for n < a.BatchSize {
+		select {
+		case <-slots:
+			n++
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+func (a *Agent) fetcher(work chan<- task, slots chan struct{}) {
 	for {
-		resp, err := http.Get(a.OrchestratorURL + "/internal/task")
+		n := a.acquireSlots(slots)
+		tasks, err := a.fetchTasks(n)
 		if err != nil {
-			log.Printf("Worker %d: error getting task: %v", id, err)
+			log.Printf("Fetcher: error getting tasks: %v", err)
 			time.Sleep(2 * time.Second)
-			continue
-		}
-		if resp.StatusCode == http.StatusNotFound {
-			resp.Body.Close()
+		} else if len(tasks) == 0 && a.TaskWait == 0 {
 			time.Sleep(1 * time.Second)
-			continue
 		}
-		var taskResp struct {
-			Task struct {
-				ID            string  `json:"id"`
-				Arg1          float64 `json:"arg1"`
-				Arg2          float64 `json:"arg2"`
-				Operation     string  `json:"operation"`
-				OperationTime int     `json:"operation_time"`
-			} `json:"task"`
+		for _, t := range tasks {
+			work <- t
 		}
-		err = json.NewDecoder(resp.Body).Decode(&taskResp)
-		resp.Body.Close()
-		if err != nil {
-			log.Printf("Worker %d: error decoding task: %v", id, err)
-			time.Sleep(1 * time.Second)
-			continue
+		for i := len(tasks); i < n; i++ {
+			slots <- struct{}{}
 		}
-		task := taskResp.Task
+	}
+}
+
+func (a *Agent) fetchTasks(n int) ([]task, error) {
+	query := url.Values{}
+	query.Set("max", strconv.Itoa(n))
+	if a.TaskWait > 0 {
+		query.Set("wait", strconv.Itoa(int(a.TaskWait/time.Second)))
+	}
+	query.Set("ops", strings.Join(a.Operations, ","))
+	taskURL := a.OrchestratorURL + "/internal/task?" + query.Encode()
+	req, err := a.newRequest(http.MethodGet, taskURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(string(body))
+	}
+	var taskResp struct {
+		Tasks []task `json:"tasks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&taskResp); err != nil {
+		return nil, err
+	}
+	return taskResp.Tasks, nil
+}
+
+func (a *Agent) worker(id int, work <-chan task, results chan<- taskResult, slots chan<- struct{}) {
+	for task := range work {
 		log.Printf("Worker %d: received task %s: %f %s %f, simulating %d ms", id, task.ID, task.Arg1, task.Operation, task.Arg2, task.OperationTime)
 		time.Sleep(time.Duration(task.OperationTime) * time.Millisecond)
 		result, err := Calc(task.Operation, task.Arg1, task.Arg2)
 		if err != nil {
 			log.Printf("Worker %d: error computing task %s: %v", id, task.ID, err)
-			continue
-		}
-		resultPayload := map[string]interface{}{
-			"id":     task.ID,
-			"result": result,
+			results <- taskResult{ID: task.ID, Error: err.Error()}
+		} else {
+			results <- taskResult{ID: task.ID, Result: result}
 		}
-		payloadBytes, _ := json.Marshal(resultPayload)
-		respPost, err := http.Post(a.OrchestratorURL+"/internal/task", "application/json", bytes.NewReader(payloadBytes))
-		if err != nil {
-			log.Printf("Worker %d: error posting result for task %s: %v", id, task.ID, err)
-			continue
+		slots <- struct{}{}
+	}
+}
+
+func (a *Agent) submitter(results <-chan taskResult) {
+	for res := range results {
+		batch := []taskResult{res}
+	collect:
+		for len(batch) < a.BatchSize {
+			select {
+			case res := <-results:
+				batch = append(batch, res)
+			default:
+				break collect
+			}
 		}
-		if respPost.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(respPost.Body)
-			log.Printf("Worker %d: error response posting result for task %s: %s", id, task.ID, string(body))
-		} else {
-			log.Printf("Worker %d: successfully completed task %s with result %f", id, task.ID, result)
+		if err := a.submitResults(batch); err != nil {
+			log.Printf("Submitter: error posting %d results: %v", len(batch), err)
 		}
-		respPost.Body.Close()
 	}
 }
 
+func (a *Agent) submitResults(batch []taskResult) error {
+	payloadBytes, _ := json.Marshal(map[string]interface{}{"results": batch})
+	req, err := a.newRequest(http.MethodPost, a.OrchestratorURL+"/internal/task", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return errors.New(string(body))
+	}
+	var statusResp struct {
+		Results []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&statusResp); err != nil {
+		return err
+	}
+	for _, st := range statusResp.Results {
+		log.Printf("Submitter: task %s: %s", st.ID, st.Status)
+	}
+	return nil
+}
+
+// identity returns the agent ID and the secret the orchestrator issued for it.
+func (a *Agent) identity() (string, string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ID, a.secret
+}
+
+func (a *Agent) setIdentity(id, secret string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ID, a.secret = id, secret
+}
+
+// newRequest builds a request to the orchestrator carrying the agent token and
+// the agent ID with its secret.
+func (a *Agent) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	req.Header.Set("Content-Type", "application/json")
+	id, secret := a.identity()
+	if id != "" {
+		req.Header.Set("X-Agent-ID", id)
+	}
+	if secret != "" {
+		req.Header.Set("X-Agent-Secret", secret)
+	}
+	return req, nil
+}
+
 func Calc(operation string, a, b float64) (float64, error) {
 	switch operation {
 	case "+":
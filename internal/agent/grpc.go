@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/agentpb"
+	"google.golang.org/grpc/metadata"
+)
+
+// callCredentials attach the agent token and, once the agent is registered,
+// its secret to every gRPC call.
+type callCredentials struct {
+	a *Agent
+}
+
+func (c callCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	md := map[string]string{"authorization": "Bearer " + c.a.Token}
+	if _, secret := c.a.identity(); secret != "" {
+		md["agent-secret"] = secret
+	}
+	return md, nil
+}
+
+func (c callCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// runStream keeps a Connect stream to the orchestrator open, reconnecting on
+// failure.
+func (a *Agent) runStream(work chan<- task, results <-chan taskResult, slots chan struct{}) {
+	for {
+		err := a.stream(work, results, slots)
+		log.Printf("Stream to orchestrator closed: %v", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// stream announces free buffer slots as credits, forwards results and puts
+// pushed tasks into the work buffer. Credits that were not used when the
+// stream breaks are returned to slots.
+func (a *Agent) stream(work chan<- task, results <-chan taskResult, slots chan struct{}) error {
+	id, _ := a.identity()
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), "agent-id", id))
+	defer cancel()
+	stream, err := a.client.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	var credits atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var msg *agentpb.AgentMessage
+			select {
+			case <-slots:
+				n := a.collectSlots(slots, 1)
+				credits.Add(int64(n))
+				msg = &agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Credits{Credits: int32(n)}}
+			case res := <-results:
+				msg = &agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Result{Result: &agentpb.TaskResult{
+					Id:     res.ID,
+					Result: res.Result,
+					Error:  res.Error,
+				}}}
+			case <-ctx.Done():
+				return
+			}
+			if err := stream.Send(msg); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			cancel()
+			<-done
+			for i := credits.Load(); i > 0; i-- {
+				slots <- struct{}{}
+			}
+			return err
+		}
+		switch p := msg.Payload.(type) {
+		case *agentpb.OrchestratorMessage_Task:
+			credits.Add(-1)
+			work <- task{
+				ID:            p.Task.Id,
+				Arg1:          p.Task.Arg1,
+				Arg2:          p.Task.Arg2,
+				Operation:     p.Task.Operation,
+				OperationTime: int(p.Task.OperationTime),
+			}
+		case *agentpb.OrchestratorMessage_Status:
+			log.Printf("Stream: task %s: %s", p.Status.Id, p.Status.Status)
+		}
+	}
+}
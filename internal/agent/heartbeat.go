@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/agentpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errNotRegistered = errors.New("agent is not registered")
+
+// register announces the agent to the orchestrator, keeps the ID and secret it
+// was given and returns the heartbeat interval.
+func (a *Agent) register() (time.Duration, error) {
+	hostname, _ := os.Hostname()
+	id, _ := a.identity()
+	if a.client != nil {
+		resp, err := a.client.Register(context.Background(), &agentpb.RegisterRequest{
+			AgentId:        id,
+			Hostname:       hostname,
+			ComputingPower: int32(a.ComputingPower),
+			Operations:     a.Operations,
+			Version:        Version,
+		})
+		if err != nil {
+			return 0, err
+		}
+		a.setIdentity(resp.AgentId, resp.AgentSecret)
+		return time.Duration(resp.HeartbeatIntervalMs) * time.Millisecond, nil
+	}
+
+	payloadBytes, _ := json.Marshal(map[string]interface{}{
+		"id":              id,
+		"hostname":        hostname,
+		"computing_power": a.ComputingPower,
+		"operations":      a.Operations,
+		"version":         Version,
+	})
+	req, err := a.newRequest(http.MethodPost, a.OrchestratorURL+"/internal/agents", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, errors.New(string(body))
+	}
+	var regResp struct {
+		ID                  string `json:"id"`
+		Secret              string `json:"secret"`
+		HeartbeatIntervalMs int    `json:"heartbeat_interval_ms"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&regResp); err != nil {
+		return 0, err
+	}
+	a.setIdentity(regResp.ID, regResp.Secret)
+	return time.Duration(regResp.HeartbeatIntervalMs) * time.Millisecond, nil
+}
+
+func (a *Agent) heartbeat() error {
+	id, _ := a.identity()
+	if a.client != nil {
+		_, err := a.client.Heartbeat(context.Background(), &agentpb.HeartbeatRequest{AgentId: id})
+		if status.Code(err) == codes.NotFound {
+			return errNotRegistered
+		}
+		return err
+	}
+
+	req, err := a.newRequest(http.MethodPost, fmt.Sprintf("%s/internal/agents/%s/heartbeat", a.OrchestratorURL, id), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errNotRegistered
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return errors.New(string(body))
+	}
+}
+
+// heartbeats reports liveness every interval and registers again when the
+// orchestrator no longer knows the agent, e.g. after a restart.
+func (a *Agent) heartbeats(interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	for {
+		time.Sleep(interval)
+		err := a.heartbeat()
+		if errors.Is(err, errNotRegistered) {
+			_, err = a.register()
+		}
+		if err != nil {
+			log.Printf("Heartbeat failed: %v", err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"crypto/subtle"
 	"errors"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -11,6 +12,10 @@ const (
 	Secret = "calculator_by_Rail-KH"
 )
 
+// HashCost is the bcrypt cost of password hashes. Tests lower it to keep
+// creating users fast.
+var HashCost = 14
+
 type User struct {
 	UserID   int
 	Login    string
@@ -18,7 +23,7 @@ type User struct {
 }
 
 func HashPass(pass string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(pass), 14)
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), HashCost)
 	return string(hash), err
 }
 
@@ -46,3 +51,17 @@ func ParseJWT(tokenString string) (int, error) {
 	}
 	return 0, errors.New("invalid data")
 }
+
+// CheckAgentToken reports whether token is one of the pre-shared agent tokens.
+func CheckAgentToken(token string, tokens []string) bool {
+	if token == "" {
+		return false
+	}
+	ok := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// CreateBatch stores a batch of the user and one pending expression per item
+// in a single transaction. It returns the batch ID and the expression IDs in
+// the order of exprs.
+func (d *DataBase) CreateBatch(ctx context.Context, userID int, exprs []string) (int, []int, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixMilli()
+	var batchID int
+	err = tx.QueryRowContext(ctx, d.dialect.rebind(
+		`INSERT INTO batches (user_id, created_at) VALUES (?, ?) RETURNING id`),
+		userID, now,
+	).Scan(&batchID)
+	if err != nil {
+		return 0, nil, d.userError(err)
+	}
+
+	ids := make([]int, len(exprs))
+	for i, expr := range exprs {
+		err := tx.QueryRowContext(ctx, d.dialect.rebind(
+			`INSERT INTO expressions (user_id, expression, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?) RETURNING id`),
+			userID, expr, "pending", now, now,
+		).Scan(&ids[i])
+		if err != nil {
+			return 0, nil, err
+		}
+		_, err = tx.ExecContext(ctx, d.dialect.rebind(
+			`INSERT INTO batch_expressions (batch_id, expression_id, position) VALUES (?, ?, ?)`),
+			batchID, ids[i], i,
+		)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+	return batchID, ids, nil
+}
+
+// GetBatch returns the expressions of a batch of the user in submission order.
+func (d *DataBase) GetBatch(ctx context.Context, id, userID int) ([]*Expression, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	var owner int
+	err := d.queryRow(ctx, `SELECT user_id FROM batches WHERE id = ?`, id).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userID) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.query(ctx,
+		`SELECT e.id, e.expression, e.status, e.result
+		FROM batch_expressions b JOIN expressions e ON e.id = b.expression_id
+		WHERE b.batch_id = ? ORDER BY b.position`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exprs := []*Expression{}
+	for rows.Next() {
+		e := &Expression{UserID: userID}
+		var result sql.NullFloat64
+		if err := rows.Scan(&e.ID, &e.Expression, &e.Status, &result); err != nil {
+			return nil, err
+		}
+		if result.Valid {
+			e.Result = &result.Float64
+		}
+		exprs = append(exprs, e)
+	}
+	return exprs, rows.Err()
+}
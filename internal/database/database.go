@@ -4,9 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/Rail-KH/Final_calc/internal/auth"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type User struct {
@@ -21,6 +21,12 @@ type Expression struct {
 	Expression string   `json:"expression"`
 	Status     string   `json:"status"`
 	Result     *float64 `json:"result"`
+	// Error is the reason an expression failed.
+	Error string `json:"error,omitempty"`
+	// CreatedAt and UpdatedAt are zero for expressions stored before they
+	// were recorded.
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 type Task struct {
@@ -34,183 +40,186 @@ type Task struct {
 	Result        sql.NullFloat64
 }
 
+// DataBase is the Storage kept in an SQL database. The queries are written
+// for SQLite; the dialect adapts them to the other supported databases.
 type DataBase struct {
-	DB *sql.DB
-}
-
-func CreateTable() (*DataBase, error) {
-	const (
-		usersTable = `
-	CREATE TABLE IF NOT EXISTS users (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            login TEXT NOT NULL UNIQUE,
-            password TEXT NOT NULL
-	);`
-
-		expressionsTable = `
-	CREATE TABLE IF NOT EXISTS expressions (
-        	id INTEGER PRIMARY KEY AUTOINCREMENT,
-            user_id INTEGER NOT NULL,
-            expression TEXT NOT NULL,
-            status TEXT NOT NULL,
-            result REAL,
-            FOREIGN KEY(user_id) REFERENCES users(id)
-	);`
-		tasksTable = `CREATE TABLE IF NOT EXISTS tasks (
-            id INTEGER PRIMARY KEY AUTOINCREMENT,
-            expression_id INTEGER NOT NULL,
-            arg1 REAL NOT NULL,
-            arg2 REAL NOT NULL,
-            operation TEXT NOT NULL,
-            operation_time INTEGER NOT NULL,
-            completed BOOLEAN DEFAULT FALSE,
-            result REAL,
-            FOREIGN KEY(expression_id) REFERENCES expressions(id)
-        );`
-	)
+	DB      *sql.DB
+	dialect *dialect
+	// timeout bounds each call; zero means no bound.
+	timeout time.Duration
+}
 
-	ctx := context.TODO()
-	db, err := sql.Open("sqlite3", "exp.db")
+// openSQL connects to a database without changing its schema.
+func openSQL(dialect *dialect, dsn string, opts Options) (*DataBase, error) {
+	db, err := sql.Open(dialect.driver, dsn)
 	if err != nil {
 		return nil, err
 	}
-
-	if _, err := db.ExecContext(ctx, usersTable); err != nil {
-		return nil, err
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
 	}
-
-	if _, err := db.ExecContext(ctx, expressionsTable); err != nil {
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
+	return &DataBase{DB: db, dialect: dialect, timeout: opts.QueryTimeout}, nil
+}
 
-	if _, err := db.ExecContext(ctx, tasksTable); err != nil {
-		return nil, err
+// Close closes the database.
+func (d *DataBase) Close() error {
+	return d.DB.Close()
+}
+
+// context bounds a call by the query timeout.
+func (d *DataBase) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, d.timeout)
+}
 
-	return &DataBase{DB: db}, nil
+// exec, query and queryRow run a query written with ? placeholders.
+func (d *DataBase) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return d.DB.ExecContext(ctx, d.dialect.rebind(query), args...)
 }
 
-func (d *DataBase) InsertUser(login, password string) (int64, error) {
+func (d *DataBase) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return d.DB.QueryContext(ctx, d.dialect.rebind(query), args...)
+}
+
+func (d *DataBase) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return d.DB.QueryRowContext(ctx, d.dialect.rebind(query), args...)
+}
+
+// userError returns ErrUnknownUser if err reports that a record was created
+// for a user that does not exist, and err otherwise.
+func (d *DataBase) userError(err error) error {
+	if d.dialect.violation(err) == foreignKeyConstraint {
+		return ErrUnknownUser
+	}
+	return err
+}
+
+func (d *DataBase) InsertUser(ctx context.Context, login, password string) (int64, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
 	var q = `
-	INSERT INTO users (login, password) values ($1, $2)
+	INSERT INTO users (login, password) values (?, ?) RETURNING id
 	`
 	hash, err := auth.HashPass(password)
 	if err != nil {
 		return 0, err
 	}
-	result, err := d.DB.Exec(q, login, hash)
-	if err != nil {
-		if isDuplicate(err) {
-			return 0, errors.New("already exists")
+	var id int64
+	if err := d.queryRow(ctx, q, login, hash).Scan(&id); err != nil {
+		if d.dialect.violation(err) == uniqueConstraint {
+			return 0, ErrDuplicateLogin
 		}
 		return 0, err
 	}
-	id, err := result.LastInsertId()
-	if err != nil {
-		return 0, err
-	}
 
 	return id, nil
 }
 
-func (d *DataBase) SelectUser(login string) (*User, error) {
+func (d *DataBase) SelectUser(ctx context.Context, login string) (*User, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
 	user := &User{}
-	var q = "SELECT id, login, password FROM users WHERE login=$1"
-	err := d.DB.QueryRow(q, login).Scan(&user.ID, &user.Login, &user.Password)
+	var q = "SELECT id, login, password FROM users WHERE login=?"
+	err := d.queryRow(ctx, q, login).Scan(&user.ID, &user.Login, &user.Password)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, errors.New("not found")
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
 	return user, nil
 }
 
-func (d *DataBase) CreateExpression(userID int, expr string) (*Expression, error) {
+func (d *DataBase) CreateExpression(ctx context.Context, userID int, expr string) (*Expression, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	now := time.UnixMilli(time.Now().UnixMilli())
 	e := &Expression{
 		UserID:     userID,
 		Expression: expr,
 		Status:     "pending",
+		CreatedAt:  now,
+		UpdatedAt:  now,
 	}
 
-	err := d.DB.QueryRow(
+	err := d.queryRow(ctx,
 		`INSERT INTO expressions 
-		(user_id, expression, status) 
-		VALUES (?, ?, ?) 
+		(user_id, expression, status, created_at, updated_at) 
+		VALUES (?, ?, ?, ?, ?) 
 		RETURNING id`,
-		e.UserID, e.Expression, e.Status,
+		e.UserID, e.Expression, e.Status, e.CreatedAt.UnixMilli(), e.UpdatedAt.UnixMilli(),
 	).Scan(&e.ID)
 
 	if err != nil {
-		return nil, err
+		return nil, d.userError(err)
 	}
 	return e, nil
 }
 
-func (d *DataBase) UpdateExpression(e *Expression) error {
+func (d *DataBase) UpdateExpression(ctx context.Context, e *Expression) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
 	var result interface{}
 	if e.Result != nil {
 		result = *e.Result
 	}
 
-	_, err := d.DB.Exec(
+	_, err := d.exec(ctx,
 		`UPDATE expressions 
-		SET status = ?, result = ? 
+		SET status = ?, result = ?, error = ?, updated_at = ? 
 		WHERE id = ? AND user_id = ?`,
-		e.Status, result, e.ID, e.UserID,
+		e.Status, result, e.Error, time.Now().UnixMilli(), e.ID, e.UserID,
 	)
 	return err
 }
 
-func (d *DataBase) GetExpressions(userID int) ([]*Expression, error) {
-	rows, err := d.DB.Query(
-		`SELECT id, expression, status, result 
-		FROM expressions WHERE user_id = ? `,
-		userID,
+// expressionColumns are the columns read by scanExpression.
+const expressionColumns = `id, expression, status, result, error, created_at, updated_at`
+
+// scanExpression reads a row of expressionColumns.
+func scanExpression(row interface{ Scan(...interface{}) error }, e *Expression) error {
+	var (
+		result           sql.NullFloat64
+		created, updated int64
 	)
-	if err != nil {
-		return nil, err
+	if err := row.Scan(&e.ID, &e.Expression, &e.Status, &result, &e.Error, &created, &updated); err != nil {
+		return err
 	}
-	defer rows.Close()
-
-	var exprs []*Expression
-	for rows.Next() {
-		e := &Expression{UserID: userID}
-		var result sql.NullFloat64
-		err := rows.Scan(&e.ID, &e.Expression, &e.Status, &result)
-		if err != nil {
-			return nil, err
-		}
-		if result.Valid {
-			e.Result = &result.Float64
-		}
-		exprs = append(exprs, e)
+	if result.Valid {
+		e.Result = &result.Float64
+	}
+	if created != 0 {
+		e.CreatedAt = time.UnixMilli(created)
+	}
+	if updated != 0 {
+		e.UpdatedAt = time.UnixMilli(updated)
 	}
-	return exprs, nil
+	return nil
 }
 
-func (d *DataBase) GetExpressionByID(id, userID int) (*Expression, error) {
-	e := &Expression{ID: id, UserID: userID}
-	var result sql.NullFloat64
-	err := d.DB.QueryRow(
-		`SELECT expression, status, result 
+func (d *DataBase) GetExpressionByID(ctx context.Context, id, userID int) (*Expression, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	e := &Expression{UserID: userID}
+	err := scanExpression(d.queryRow(ctx,
+		`SELECT `+expressionColumns+` 
 		FROM expressions WHERE id = ? AND user_id = ?`,
 		id, userID,
-	).Scan(&e.Expression, &e.Status, &result)
+	), e)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, errors.New("not found")
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
-
-	if result.Valid {
-		e.Result = &result.Float64
-	}
 	return e, nil
 }
-
-func isDuplicate(err error) bool {
-	return err != nil && err.Error() == "UNIQUE constraint failed: users.login"
-}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// dialect adapts the SQLite queries of DataBase to a database.
+type dialect struct {
+	driver string
+	// numbered databases take $1, $2, ... instead of ? placeholders.
+	numbered bool
+	// types rewrites the column types of the schema.
+	types *strings.Replacer
+	// like is the case-insensitive LIKE operator.
+	like string
+	// hasTable counts the tables with a name.
+	hasTable string
+	// adopt prepares a database created before migrations were versioned
+	// for the first migration.
+	adopt func(ctx context.Context, tx *sql.Tx) error
+	// violation returns the kind of constraint an error of the driver
+	// reports as violated.
+	violation func(err error) constraint
+}
+
+// constraint is a kind of constraint of the schema.
+type constraint int
+
+const (
+	noConstraint constraint = iota
+	uniqueConstraint
+	foreignKeyConstraint
+)
+
+var sqliteDialect = &dialect{
+	driver:   "sqlite3",
+	like:     "LIKE",
+	hasTable: `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`,
+	adopt:    adoptSQLite,
+	violation: func(err error) constraint {
+		var e sqlite3.Error
+		if !errors.As(err, &e) {
+			return noConstraint
+		}
+		switch e.ExtendedCode {
+		case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey:
+			return uniqueConstraint
+		case sqlite3.ErrConstraintForeignKey:
+			return foreignKeyConstraint
+		}
+		return noConstraint
+	},
+}
+
+// sqliteOptions are the connection options of SQLite databases unless the
+// URL sets them: concurrent readers while writing, waiting for locks instead
+// of failing at once, enforced foreign keys and transactions that take the
+// write lock when they begin, so they wait for it rather than fail midway.
+var sqliteOptions = [][2]string{
+	{"_journal_mode", "WAL"},
+	{"_busy_timeout", "5000"},
+	{"_foreign_keys", "on"},
+	{"_txlock", "immediate"},
+}
+
+// sqliteDSN returns the DSN of the database file at path, which may be
+// followed by ?options of the driver.
+func sqliteDSN(path string) (string, error) {
+	path, query, _ := strings.Cut(path, "?")
+	if path == "" {
+		return "", errors.New("no database file")
+	}
+	options, err := url.ParseQuery(query)
+	if err != nil {
+		return "", err
+	}
+	for _, option := range sqliteOptions {
+		if !options.Has(option[0]) {
+			options.Set(option[0], option[1])
+		}
+	}
+	return "file:" + path + "?" + options.Encode(), nil
+}
+
+// rebind replaces the ? placeholders of a query for numbered databases.
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ddl adapts the statements of a migration.
+func (d *dialect) ddl(stmt string) string {
+	if d.types == nil {
+		return stmt
+	}
+	return d.types.Replace(stmt)
+}
+
+// adoptSQLite adds the columns that databases created before they were
+// recorded lack, so the first migration can create its indexes.
+func adoptSQLite(ctx context.Context, tx *sql.Tx) error {
+	for _, column := range []struct{ name, definition string }{
+		{"created_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"updated_at", "INTEGER NOT NULL DEFAULT 0"},
+		{"error", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		var n int
+		err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info('expressions') WHERE name = ?`, column.name).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE expressions ADD COLUMN `+column.name+` `+column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned by ListExpressions for a cursor that was not
+// produced by the same sort.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// effectiveStatus is the status an expression is reported with: expressions
+// whose tasks are running may be stored as "completed" without a result.
+const effectiveStatus = `CASE WHEN status = 'completed' AND result IS NULL THEN 'pending' ELSE status END`
+
+// listColumns are expressionColumns with the effective status.
+const listColumns = `id, expression, ` + effectiveStatus + `, result, error, created_at, updated_at`
+
+// expressionSorts maps the sort options of ListExpressions to columns.
+var expressionSorts = map[string]string{
+	"id":         "id",
+	"created_at": "created_at",
+	"status":     effectiveStatus,
+	"expression": "expression",
+}
+
+// ExpressionFilter selects expressions of a user.
+type ExpressionFilter struct {
+	// Statuses keeps expressions with one of these statuses; empty means all.
+	Statuses []string
+	// From and To bound the creation time to [From, To); zero means unbounded.
+	From, To time.Time
+	// Search keeps expressions containing this text, ignoring case.
+	Search string
+}
+
+// Empty reports whether the filter selects every expression.
+func (f ExpressionFilter) Empty() bool {
+	return len(f.Statuses) == 0 && f.From.IsZero() && f.To.IsZero() && f.Search == ""
+}
+
+// where returns the SQL conditions of the filter and their arguments.
+func (f ExpressionFilter) where(dialect *dialect, userID int) ([]string, []interface{}) {
+	where := []string{"user_id = ?"}
+	args := []interface{}{userID}
+	if len(f.Statuses) > 0 {
+		where = append(where, effectiveStatus+" IN (?"+strings.Repeat(", ?", len(f.Statuses)-1)+")")
+		for _, status := range f.Statuses {
+			args = append(args, status)
+		}
+	}
+	if !f.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.From.UnixMilli())
+	}
+	if !f.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.To.UnixMilli())
+	}
+	if f.Search != "" {
+		where = append(where, `expression `+dialect.like+` ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(f.Search)+"%")
+	}
+	return where, args
+}
+
+// ExpressionQuery selects a page of the expressions of a user.
+type ExpressionQuery struct {
+	ExpressionFilter
+	// Sort is "id" (default), "created_at", "status" or "expression".
+	Sort string
+	Desc bool
+	// Limit is the page size; Cursor is the NextCursor of the previous page.
+	Limit  int
+	Cursor string
+}
+
+// ExpressionPage is a page of expressions. NextCursor is empty on the last page.
+type ExpressionPage struct {
+	Expressions []*Expression
+	NextCursor  string
+}
+
+// expressionCursor is the position after the last row of a page: the sort
+// value of that row and its ID, which breaks ties.
+type expressionCursor struct {
+	Sort string `json:"s"`
+	Desc bool   `json:"d,omitempty"`
+	ID   int    `json:"id"`
+	Int  int64  `json:"n,omitempty"`
+	Text string `json:"t,omitempty"`
+}
+
+func encodeCursor(c expressionCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (expressionCursor, error) {
+	var c expressionCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &c) != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// ValidExpressionSort reports whether sort is a sort option of ListExpressions.
+func ValidExpressionSort(sort string) bool {
+	_, ok := expressionSorts[sort]
+	return ok
+}
+
+// ListExpressions returns a page of the expressions of a user that match q,
+// ordered by q.Sort and then by ID.
+func (d *DataBase) ListExpressions(ctx context.Context, userID int, q ExpressionQuery) (*ExpressionPage, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	if q.Sort == "" {
+		q.Sort = "id"
+	}
+	column, ok := expressionSorts[q.Sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	where, args := q.where(d.dialect, userID)
+	cmp, order := ">", "ASC"
+	if q.Desc {
+		cmp, order = "<", "DESC"
+	}
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.Sort != q.Sort || c.Desc != q.Desc {
+			return nil, ErrInvalidCursor
+		}
+		switch q.Sort {
+		case "id":
+			where = append(where, "id "+cmp+" ?")
+			args = append(args, c.ID)
+		case "created_at":
+			where = append(where, "(created_at, id) "+cmp+" (?, ?)")
+			args = append(args, c.Int, c.ID)
+		default:
+			where = append(where, "("+column+", id) "+cmp+" (?, ?)")
+			args = append(args, c.Text, c.ID)
+		}
+	}
+	orderBy := "id " + order
+	if q.Sort != "id" {
+		orderBy = column + " " + order + ", " + orderBy
+	}
+	args = append(args, q.Limit+1)
+
+	rows, err := d.query(ctx,
+		`SELECT `+listColumns+` FROM expressions WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY `+orderBy+` LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &ExpressionPage{Expressions: []*Expression{}}
+	for rows.Next() {
+		e := &Expression{UserID: userID}
+		if err := scanExpression(rows, e); err != nil {
+			return nil, err
+		}
+		page.Expressions = append(page.Expressions, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Expressions) > q.Limit {
+		page.Expressions = page.Expressions[:q.Limit]
+		last := page.Expressions[q.Limit-1]
+		c := expressionCursor{Sort: q.Sort, Desc: q.Desc, ID: last.ID}
+		switch q.Sort {
+		case "created_at":
+			if !last.CreatedAt.IsZero() {
+				c.Int = last.CreatedAt.UnixMilli()
+			}
+		case "status":
+			c.Text = last.Status
+		case "expression":
+			c.Text = last.Expression
+		}
+		page.NextCursor = encodeCursor(c)
+	}
+	return page, nil
+}
+
+// ExportExpressions calls fn for every expression of the user that matches
+// the filter, in ID order, while reading the rows from the database. It stops
+// at the first error returned by fn.
+func (d *DataBase) ExportExpressions(ctx context.Context, userID int, f ExpressionFilter, fn func(*Expression) error) error {
+	where, args := f.where(d.dialect, userID)
+	rows, err := d.query(ctx,
+		`SELECT `+listColumns+` FROM expressions WHERE `+strings.Join(where, " AND ")+` ORDER BY id`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := &Expression{UserID: userID}
+		if err := scanExpression(rows, e); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
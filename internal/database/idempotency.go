@@ -0,0 +1,96 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// IdempotentResponse is the stored outcome of a request made with an
+// Idempotency-Key. StatusCode is 0 while the request is still being handled.
+type IdempotentResponse struct {
+	RequestHash string
+	StatusCode  int
+	Body        string
+}
+
+// ReserveIdempotencyKey claims key for a new request of the user at now. Keys
+// created before expiredBefore are forgotten first, and a reservation still in
+// progress that was made before abandonedBefore is taken over, since its
+// request will not finish. If the key is already taken the stored response is
+// returned, otherwise the result is nil and the caller must either save a
+// response or delete the key.
+func (d *DataBase) ReserveIdempotencyKey(ctx context.Context, userID int, key, requestHash string, now, expiredBefore, abandonedBefore time.Time) (*IdempotentResponse, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, d.dialect.rebind(`DELETE FROM idempotency_keys WHERE created_at < ?`), expiredBefore.UnixMilli()); err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, d.dialect.rebind(
+		`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND status_code = 0 AND created_at < ?`),
+		userID, key, abandonedBefore.UnixMilli(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// A conflicting key may be deleted by another request before it is read,
+	// in which case the insert is tried again.
+	for attempt := 0; attempt < 2; attempt++ {
+		result, err := tx.ExecContext(ctx, d.dialect.rebind(
+			`INSERT INTO idempotency_keys (user_id, key, request_hash, created_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(user_id, key) DO NOTHING`),
+			userID, key, requestHash, now.UnixMilli(),
+		)
+		if err != nil {
+			return nil, d.userError(err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 1 {
+			return nil, tx.Commit()
+		}
+
+		stored := &IdempotentResponse{}
+		err = tx.QueryRowContext(ctx, d.dialect.rebind(
+			`SELECT request_hash, status_code, response FROM idempotency_keys WHERE user_id = ? AND key = ?`),
+			userID, key,
+		).Scan(&stored.RequestHash, &stored.StatusCode, &stored.Body)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return stored, tx.Commit()
+	}
+	// The key keeps changing hands, so it is reported as in progress.
+	return &IdempotentResponse{RequestHash: requestHash}, tx.Commit()
+}
+
+// SaveIdempotentResponse stores the response of a request that reserved key
+// at reservedAt. Nothing is stored if the reservation was taken over.
+func (d *DataBase) SaveIdempotentResponse(ctx context.Context, userID int, key string, reservedAt time.Time, statusCode int, body string) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	_, err := d.exec(ctx,
+		`UPDATE idempotency_keys SET status_code = ?, response = ? WHERE user_id = ? AND key = ? AND created_at = ?`,
+		statusCode, body, userID, key, reservedAt.UnixMilli(),
+	)
+	return err
+}
+
+// DeleteIdempotencyKey releases the reservation of key made at reservedAt so
+// the request can be retried.
+func (d *DataBase) DeleteIdempotencyKey(ctx context.Context, userID int, key string, reservedAt time.Time) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	_, err := d.exec(ctx, `DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND created_at = ?`, userID, key, reservedAt.UnixMilli())
+	return err
+}
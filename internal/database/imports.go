@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ImportJob is an upload of expressions and the outcome of its lines.
+type ImportJob struct {
+	ID       int    `json:"id"`
+	UserID   int    `json:"-"`
+	Filename string `json:"filename"`
+	Format   string `json:"format"`
+	// Status is "running", "completed" or "failed" if the upload could not
+	// be read to the end.
+	Status     string    `json:"status"`
+	Total      int       `json:"total"`
+	Accepted   int       `json:"accepted"`
+	Rejected   int       `json:"rejected"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// ImportLine is the outcome of a line of an upload: the ID of the created
+// expression or the reason the line was rejected.
+type ImportLine struct {
+	Line         int    `json:"line"`
+	ExpressionID int    `json:"expression_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+func (d *DataBase) CreateImportJob(ctx context.Context, job *ImportJob) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	err := d.queryRow(ctx,
+		`INSERT INTO import_jobs (user_id, filename, format, status, created_at)
+		VALUES (?, ?, ?, ?, ?) RETURNING id`,
+		job.UserID, job.Filename, job.Format, job.Status, job.CreatedAt.UnixMilli(),
+	).Scan(&job.ID)
+	return d.userError(err)
+}
+
+// AddImportLines stores the outcome of lines of a job in one transaction.
+func (d *DataBase) AddImportLines(ctx context.Context, jobID int, lines []ImportLine) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, l := range lines {
+		var exprID interface{}
+		if l.ExpressionID != 0 {
+			exprID = l.ExpressionID
+		}
+		_, err := tx.ExecContext(ctx, d.dialect.rebind(
+			`INSERT INTO import_lines (job_id, line, expression_id, error) VALUES (?, ?, ?, ?)`),
+			jobID, l.Line, exprID, l.Error,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *DataBase) UpdateImportJob(ctx context.Context, job *ImportJob) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	_, err := d.exec(ctx,
+		`UPDATE import_jobs
+		SET status = ?, total = ?, accepted = ?, rejected = ?, error = ?, finished_at = ?
+		WHERE id = ?`,
+		job.Status, job.Total, job.Accepted, job.Rejected, job.Error, job.FinishedAt.UnixMilli(),
+		job.ID,
+	)
+	return err
+}
+
+// GetImportJob returns an import job of the user.
+func (d *DataBase) GetImportJob(ctx context.Context, id, userID int) (*ImportJob, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	job := &ImportJob{}
+	var created, finished int64
+	err := d.queryRow(ctx,
+		`SELECT id, user_id, filename, format, status, total, accepted, rejected, error, created_at, finished_at
+		FROM import_jobs WHERE id = ? AND user_id = ?`,
+		id, userID,
+	).Scan(&job.ID, &job.UserID, &job.Filename, &job.Format, &job.Status, &job.Total, &job.Accepted, &job.Rejected,
+		&job.Error, &created, &finished)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	job.CreatedAt = time.UnixMilli(created)
+	if finished != 0 {
+		job.FinishedAt = time.UnixMilli(finished)
+	}
+	return job, nil
+}
+
+// GetImportLines returns the lines of a job in file order, only the rejected
+// ones if rejectedOnly is set.
+func (d *DataBase) GetImportLines(ctx context.Context, jobID int, rejectedOnly bool) ([]ImportLine, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	q := `SELECT line, expression_id, error FROM import_lines WHERE job_id = ?`
+	if rejectedOnly {
+		q += ` AND expression_id IS NULL`
+	}
+	rows, err := d.query(ctx, q+` ORDER BY line`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lines := []ImportLine{}
+	for rows.Next() {
+		var (
+			l      ImportLine
+			exprID sql.NullInt64
+		)
+		if err := rows.Scan(&l.Line, &exprID, &l.Error); err != nil {
+			return nil, err
+		}
+		l.ExpressionID = int(exprID.Int64)
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
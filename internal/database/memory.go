@@ -0,0 +1,729 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/auth"
+)
+
+// Memory is a Storage kept in memory. It behaves like DataBase but loses
+// everything when the process exits, which keeps tests independent of each
+// other. Its calls never wait, so they check the context when they start and
+// ExportExpressions also between rows.
+type Memory struct {
+	mu          sync.Mutex
+	users       []*User
+	expressions map[int]*Expression
+	batches     map[int]*memoryBatch
+	idempotency map[idempotencyKey]*memoryIdempotency
+	webhooks    map[int]string
+	retention   map[int]Retention
+	deliveries  map[int]*Delivery
+	importJobs  map[int]*ImportJob
+	importLines map[int][]ImportLine
+	lastID      struct{ expression, batch, delivery, importJob int }
+}
+
+type memoryBatch struct {
+	userID      int
+	expressions []int
+}
+
+type idempotencyKey struct {
+	userID int
+	key    string
+}
+
+type memoryIdempotency struct {
+	IdempotentResponse
+	created time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		expressions: make(map[int]*Expression),
+		batches:     make(map[int]*memoryBatch),
+		idempotency: make(map[idempotencyKey]*memoryIdempotency),
+		webhooks:    make(map[int]string),
+		retention:   make(map[int]Retention),
+		deliveries:  make(map[int]*Delivery),
+		importJobs:  make(map[int]*ImportJob),
+		importLines: make(map[int][]ImportLine),
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// nowMillis returns the current time at the millisecond precision of
+// DataBase.
+func nowMillis() time.Time {
+	return time.UnixMilli(time.Now().UnixMilli())
+}
+
+func (m *Memory) InsertUser(ctx context.Context, login, password string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	hash, err := auth.HashPass(password)
+	if err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Login == login {
+			return 0, ErrDuplicateLogin
+		}
+	}
+	user := &User{ID: int64(len(m.users) + 1), Login: login, Password: hash}
+	m.users = append(m.users, user)
+	return user.ID, nil
+}
+
+func (m *Memory) SelectUser(ctx context.Context, login string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.users {
+		if u.Login == login {
+			user := *u
+			return &user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// hasUser reports whether the user exists, as the foreign keys of DataBase
+// require. It must be called with m.mu held.
+func (m *Memory) hasUser(userID int) bool {
+	return userID >= 1 && userID <= len(m.users)
+}
+
+// copyExpression returns a copy of e that does not share its result.
+func copyExpression(e *Expression) *Expression {
+	c := *e
+	if e.Result != nil {
+		result := *e.Result
+		c.Result = &result
+	}
+	return &c
+}
+
+func (m *Memory) CreateExpression(ctx context.Context, userID int, expr string) (*Expression, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.hasUser(userID) {
+		return nil, ErrUnknownUser
+	}
+	return copyExpression(m.createExpression(userID, expr, nowMillis())), nil
+}
+
+// createExpression must be called with m.mu held.
+func (m *Memory) createExpression(userID int, expr string, created time.Time) *Expression {
+	m.lastID.expression++
+	e := &Expression{
+		UserID:     userID,
+		ID:         m.lastID.expression,
+		Expression: expr,
+		Status:     "pending",
+		CreatedAt:  created,
+		UpdatedAt:  created,
+	}
+	m.expressions[e.ID] = e
+	return e
+}
+
+func (m *Memory) UpdateExpression(ctx context.Context, e *Expression) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.expressions[e.ID]
+	if !ok || stored.UserID != e.UserID {
+		return nil
+	}
+	updated := copyExpression(e)
+	stored.Status, stored.Result, stored.Error, stored.UpdatedAt = updated.Status, updated.Result, updated.Error, nowMillis()
+	return nil
+}
+
+func (m *Memory) GetExpressionByID(ctx context.Context, id, userID int) (*Expression, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.expressions[id]
+	if !ok || e.UserID != userID {
+		return nil, ErrNotFound
+	}
+	return copyExpression(e), nil
+}
+
+// listed returns a copy of e with the status it is listed with, as
+// effectiveStatus does.
+func listed(e *Expression) *Expression {
+	c := copyExpression(e)
+	if c.Status == "completed" && c.Result == nil {
+		c.Status = "pending"
+	}
+	return c
+}
+
+// match reports whether the filter selects e, which has its listed status.
+func (f ExpressionFilter) match(e *Expression) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, status := range f.Statuses {
+			found = found || status == e.Status
+		}
+		if !found {
+			return false
+		}
+	}
+	if !f.From.IsZero() && e.CreatedAt.UnixMilli() < f.From.UnixMilli() {
+		return false
+	}
+	if !f.To.IsZero() && e.CreatedAt.UnixMilli() >= f.To.UnixMilli() {
+		return false
+	}
+	return f.Search == "" || strings.Contains(strings.ToLower(e.Expression), strings.ToLower(f.Search))
+}
+
+// filter returns the listed expressions of the user that match f, in ID
+// order. It must be called with m.mu held.
+func (m *Memory) filter(userID int, f ExpressionFilter) []*Expression {
+	exprs := []*Expression{}
+	for _, e := range m.expressions {
+		if e.UserID != userID {
+			continue
+		}
+		if e := listed(e); f.match(e) {
+			exprs = append(exprs, e)
+		}
+	}
+	sort.Slice(exprs, func(i, j int) bool { return exprs[i].ID < exprs[j].ID })
+	return exprs
+}
+
+// sortKey returns the value an expression is sorted by: the creation time in
+// milliseconds or a text.
+func sortKey(e *Expression, sort string) (int64, string) {
+	switch sort {
+	case "created_at":
+		if e.CreatedAt.IsZero() {
+			return 0, ""
+		}
+		return e.CreatedAt.UnixMilli(), ""
+	case "status":
+		return 0, e.Status
+	case "expression":
+		return 0, e.Expression
+	}
+	return 0, ""
+}
+
+// compareSort orders a by the sort value and then by ID against the position
+// given by the sort value and ID of another expression.
+func compareSort(a *Expression, sort string, n int64, text string, id int) int {
+	an, atext := sortKey(a, sort)
+	switch {
+	case an != n:
+		if an < n {
+			return -1
+		}
+		return 1
+	case atext != text:
+		if atext < text {
+			return -1
+		}
+		return 1
+	case a.ID != id:
+		if a.ID < id {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func (m *Memory) ListExpressions(ctx context.Context, userID int, q ExpressionQuery) (*ExpressionPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if q.Sort == "" {
+		q.Sort = "id"
+	}
+	if !ValidExpressionSort(q.Sort) {
+		return nil, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	var cursor *expressionCursor
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.Sort != q.Sort || c.Desc != q.Desc {
+			return nil, ErrInvalidCursor
+		}
+		cursor = &c
+	}
+
+	m.mu.Lock()
+	exprs := m.filter(userID, q.ExpressionFilter)
+	m.mu.Unlock()
+
+	order := func(cmp int) bool {
+		if q.Desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+	sort.SliceStable(exprs, func(i, j int) bool {
+		n, text := sortKey(exprs[j], q.Sort)
+		return order(compareSort(exprs[i], q.Sort, n, text, exprs[j].ID))
+	})
+
+	page := &ExpressionPage{Expressions: []*Expression{}}
+	for _, e := range exprs {
+		if cursor != nil && !order(-compareSort(e, q.Sort, cursor.Int, cursor.Text, cursor.ID)) {
+			continue
+		}
+		if len(page.Expressions) == q.Limit {
+			last := page.Expressions[q.Limit-1]
+			c := expressionCursor{Sort: q.Sort, Desc: q.Desc, ID: last.ID}
+			c.Int, c.Text = sortKey(last, q.Sort)
+			page.NextCursor = encodeCursor(c)
+			break
+		}
+		page.Expressions = append(page.Expressions, e)
+	}
+	return page, nil
+}
+
+func (m *Memory) ExportExpressions(ctx context.Context, userID int, f ExpressionFilter, fn func(*Expression) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	exprs := m.filter(userID, f)
+	m.mu.Unlock()
+	for _, e := range exprs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) DeleteExpression(ctx context.Context, id, userID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.expressions[id]
+	if !ok || e.UserID != userID {
+		return ErrNotFound
+	}
+	m.deleteExpressions([]int{id})
+	return nil
+}
+
+// finished reports whether an expression will not change any more.
+func finished(e *Expression) bool {
+	switch listed(e).Status {
+	case "completed", "error", "cancelled":
+		return true
+	}
+	return false
+}
+
+func (m *Memory) DeleteExpressions(ctx context.Context, userID int, f ExpressionFilter) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []int
+	for _, e := range m.filter(userID, f) {
+		if finished(e) {
+			ids = append(ids, e.ID)
+		}
+	}
+	m.deleteExpressions(ids)
+	return ids, nil
+}
+
+func (m *Memory) PurgeExpressions(ctx context.Context, now time.Time, maxAge time.Duration, keep int) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// position counts the expressions of each user from the newest one.
+	byUser := make(map[int][]*Expression)
+	for _, e := range m.expressions {
+		byUser[e.UserID] = append(byUser[e.UserID], e)
+	}
+	var ids []int
+	for userID, exprs := range byUser {
+		ageMs, count := maxAge.Milliseconds(), keep
+		if r := m.retention[userID]; r.MaxAge != nil {
+			ageMs = int64(*r.MaxAge)
+		}
+		if r := m.retention[userID]; r.MaxCount != nil {
+			count = *r.MaxCount
+		}
+		sort.Slice(exprs, func(i, j int) bool { return exprs[i].ID > exprs[j].ID })
+		for position, e := range exprs {
+			old := ageMs > 0 && e.CreatedAt.UnixMilli() < now.UnixMilli()-ageMs
+			if finished(e) && (old || (count > 0 && position >= count)) {
+				ids = append(ids, e.ID)
+			}
+		}
+	}
+	sort.Ints(ids)
+	m.deleteExpressions(ids)
+	return ids, nil
+}
+
+func (m *Memory) SetRetention(ctx context.Context, userID int, r Retention) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.hasUser(userID) {
+		return ErrUnknownUser
+	}
+	m.retention[userID] = r
+	return nil
+}
+
+func (m *Memory) GetRetention(ctx context.Context, userID int) (Retention, error) {
+	if err := ctx.Err(); err != nil {
+		return Retention{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.hasUser(userID) {
+		return Retention{}, ErrUnknownUser
+	}
+	return m.retention[userID], nil
+}
+
+// deleteExpressions removes expressions and what references them. It must be
+// called with m.mu held.
+func (m *Memory) deleteExpressions(ids []int) {
+	deleted := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+		delete(m.expressions, id)
+	}
+	for _, b := range m.batches {
+		kept := b.expressions[:0]
+		for _, id := range b.expressions {
+			if !deleted[id] {
+				kept = append(kept, id)
+			}
+		}
+		b.expressions = kept
+	}
+	for id, dl := range m.deliveries {
+		if deleted[dl.ExpressionID] {
+			delete(m.deliveries, id)
+		}
+	}
+}
+
+func (m *Memory) CreateBatch(ctx context.Context, userID int, exprs []string) (int, []int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.hasUser(userID) {
+		return 0, nil, ErrUnknownUser
+	}
+	created := nowMillis()
+	m.lastID.batch++
+	batch := &memoryBatch{userID: userID}
+	for _, expr := range exprs {
+		batch.expressions = append(batch.expressions, m.createExpression(userID, expr, created).ID)
+	}
+	m.batches[m.lastID.batch] = batch
+	return m.lastID.batch, append([]int(nil), batch.expressions...), nil
+}
+
+func (m *Memory) GetBatch(ctx context.Context, id, userID int) ([]*Expression, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	batch, ok := m.batches[id]
+	if !ok || batch.userID != userID {
+		return nil, ErrNotFound
+	}
+	exprs := []*Expression{}
+	for _, id := range batch.expressions {
+		exprs = append(exprs, copyExpression(m.expressions[id]))
+	}
+	return exprs, nil
+}
+
+func (m *Memory) ReserveIdempotencyKey(ctx context.Context, userID int, key, requestHash string, now, expiredBefore, abandonedBefore time.Time) (*IdempotentResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, stored := range m.idempotency {
+		if stored.created.UnixMilli() < expiredBefore.UnixMilli() {
+			delete(m.idempotency, k)
+		}
+	}
+	k := idempotencyKey{userID, key}
+	if stored, ok := m.idempotency[k]; ok && stored.StatusCode == 0 && stored.created.UnixMilli() < abandonedBefore.UnixMilli() {
+		delete(m.idempotency, k)
+	}
+	if stored, ok := m.idempotency[k]; ok {
+		response := stored.IdempotentResponse
+		return &response, nil
+	}
+	if !m.hasUser(userID) {
+		return nil, ErrUnknownUser
+	}
+	m.idempotency[k] = &memoryIdempotency{IdempotentResponse{RequestHash: requestHash}, now}
+	return nil, nil
+}
+
+func (m *Memory) SaveIdempotentResponse(ctx context.Context, userID int, key string, reservedAt time.Time, statusCode int, body string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stored, ok := m.idempotency[idempotencyKey{userID, key}]; ok && stored.created.UnixMilli() == reservedAt.UnixMilli() {
+		stored.StatusCode, stored.Body = statusCode, body
+	}
+	return nil
+}
+
+func (m *Memory) DeleteIdempotencyKey(ctx context.Context, userID int, key string, reservedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := idempotencyKey{userID, key}
+	if stored, ok := m.idempotency[k]; ok && stored.created.UnixMilli() == reservedAt.UnixMilli() {
+		delete(m.idempotency, k)
+	}
+	return nil
+}
+
+func (m *Memory) SetWebhook(ctx context.Context, userID int, url string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case url == "":
+		delete(m.webhooks, userID)
+	case !m.hasUser(userID):
+		return ErrUnknownUser
+	default:
+		m.webhooks[userID] = url
+	}
+	return nil
+}
+
+func (m *Memory) GetWebhook(ctx context.Context, userID int) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.webhooks[userID], nil
+}
+
+// millis truncates the times of a delivery to milliseconds, as DataBase
+// stores them.
+func (dl *Delivery) millis() {
+	dl.NextAttempt = time.UnixMilli(dl.NextAttempt.UnixMilli())
+	dl.CreatedAt = time.UnixMilli(dl.CreatedAt.UnixMilli())
+	dl.UpdatedAt = time.UnixMilli(dl.UpdatedAt.UnixMilli())
+}
+
+func (m *Memory) CreateDelivery(ctx context.Context, dl *Delivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastID.delivery++
+	dl.ID = m.lastID.delivery
+	stored := *dl
+	stored.millis()
+	m.deliveries[dl.ID] = &stored
+	return nil
+}
+
+func (m *Memory) UpdateDelivery(ctx context.Context, dl *Delivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.deliveries[dl.ID]
+	if !ok {
+		return nil
+	}
+	stored.Status, stored.Attempts, stored.NextAttempt = dl.Status, dl.Attempts, dl.NextAttempt
+	stored.LastError, stored.ResponseCode, stored.UpdatedAt = dl.LastError, dl.ResponseCode, dl.UpdatedAt
+	stored.millis()
+	return nil
+}
+
+// selectDeliveries returns copies of the deliveries selected by keep, ordered by
+// less and cut to limit. It must be called with m.mu held.
+func (m *Memory) selectDeliveries(keep func(*Delivery) bool, less func(a, b *Delivery) bool, limit int) []*Delivery {
+	deliveries := []*Delivery{}
+	for _, dl := range m.deliveries {
+		if keep(dl) {
+			c := *dl
+			deliveries = append(deliveries, &c)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return less(deliveries[i], deliveries[j]) })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries
+}
+
+func (m *Memory) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]*Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectDeliveries(
+		func(dl *Delivery) bool {
+			return dl.Status == "pending" && dl.NextAttempt.UnixMilli() <= now.UnixMilli()
+		},
+		func(a, b *Delivery) bool {
+			if !a.NextAttempt.Equal(b.NextAttempt) {
+				return a.NextAttempt.Before(b.NextAttempt)
+			}
+			return a.ID < b.ID
+		},
+		limit,
+	), nil
+}
+
+func (m *Memory) GetDeliveries(ctx context.Context, userID, limit int) ([]*Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selectDeliveries(
+		func(dl *Delivery) bool { return dl.UserID == userID },
+		func(a, b *Delivery) bool { return a.ID > b.ID },
+		limit,
+	), nil
+}
+
+func (m *Memory) CreateImportJob(ctx context.Context, job *ImportJob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.hasUser(job.UserID) {
+		return ErrUnknownUser
+	}
+	m.lastID.importJob++
+	job.ID = m.lastID.importJob
+	stored := *job
+	stored.CreatedAt = time.UnixMilli(job.CreatedAt.UnixMilli())
+	m.importJobs[job.ID] = &stored
+	return nil
+}
+
+func (m *Memory) AddImportLines(ctx context.Context, jobID int, lines []ImportLine) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.importLines[jobID] = append(m.importLines[jobID], lines...)
+	return nil
+}
+
+func (m *Memory) UpdateImportJob(ctx context.Context, job *ImportJob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.importJobs[job.ID]
+	if !ok {
+		return nil
+	}
+	stored.Status, stored.Total, stored.Accepted, stored.Rejected = job.Status, job.Total, job.Accepted, job.Rejected
+	stored.Error = job.Error
+	stored.FinishedAt = time.Time{}
+	if !job.FinishedAt.IsZero() {
+		stored.FinishedAt = time.UnixMilli(job.FinishedAt.UnixMilli())
+	}
+	return nil
+}
+
+func (m *Memory) GetImportJob(ctx context.Context, id, userID int) (*ImportJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.importJobs[id]
+	if !ok || job.UserID != userID {
+		return nil, ErrNotFound
+	}
+	c := *job
+	return &c, nil
+}
+
+func (m *Memory) GetImportLines(ctx context.Context, jobID int, rejectedOnly bool) ([]ImportLine, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lines := []ImportLine{}
+	for _, l := range m.importLines[jobID] {
+		if !rejectedOnly || l.ExpressionID == 0 {
+			lines = append(lines, l)
+		}
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Line < lines[j].Line })
+	return lines, nil
+}
@@ -0,0 +1,182 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a versioned change of the schema, read from the file
+// migrations/NNNN_name.sql. Like the queries of DataBase it is written for
+// SQLite and adapted by the dialect.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationState is a migration and the time it was applied, which is zero
+// for a pending migration.
+type MigrationState struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// schemaVersionTable records the applied migrations.
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+    version INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    applied_at INTEGER NOT NULL
+)`
+
+// Migrations returns the embedded migrations in version order.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, entry := range entries {
+		number, name, _ := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(number)
+		if err != nil || version != len(migrations)+1 {
+			return nil, fmt.Errorf("migration %s: expected version %d", entry.Name(), len(migrations)+1)
+		}
+		data, err := migrationFiles.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(data)})
+	}
+	return migrations, nil
+}
+
+// Migrate applies the pending migrations up to the target version, or all of
+// them if target is 0. Each migration is applied in its own transaction,
+// without the query timeout. It returns the applied migrations.
+func (d *DataBase) Migrate(ctx context.Context, target int) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if target == 0 {
+		target = len(migrations)
+	}
+	if target < 0 || target > len(migrations) {
+		return nil, fmt.Errorf("unknown schema version %d", target)
+	}
+	if _, err := d.DB.ExecContext(ctx, d.dialect.ddl(schemaVersionTable)); err != nil {
+		return nil, err
+	}
+	version, err := d.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version > len(migrations) {
+		return nil, fmt.Errorf("schema version %d is newer than this build (%d)", version, len(migrations))
+	}
+	if target < version {
+		return nil, fmt.Errorf("schema is at version %d, migrations cannot be reverted", version)
+	}
+
+	var applied []Migration
+	for _, m := range migrations[version:target] {
+		if err := d.apply(ctx, m); err != nil {
+			return applied, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func (d *DataBase) apply(ctx context.Context, m Migration) error {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Databases created before migrations were versioned already have
+	// tables of the first migration.
+	if m.Version == 1 && d.dialect.adopt != nil {
+		legacy, err := d.hasTable(ctx, tx, "expressions")
+		if err != nil {
+			return err
+		}
+		if legacy {
+			if err := d.dialect.adopt(ctx, tx); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, d.dialect.ddl(m.SQL)); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, d.dialect.rebind(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`),
+		m.Version, m.Name, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Version returns the latest applied migration, 0 if there is none.
+func (d *DataBase) Version(ctx context.Context) (int, error) {
+	exists, err := d.hasTable(ctx, d.DB, "schema_version")
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = d.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// MigrationStates returns every migration and when it was applied.
+func (d *DataBase) MigrationStates(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]MigrationState, len(migrations))
+	for i, m := range migrations {
+		states[i].Migration = m
+	}
+	exists, err := d.hasTable(ctx, d.DB, "schema_version")
+	if err != nil || !exists {
+		return states, err
+	}
+
+	rows, err := d.DB.QueryContext(ctx, `SELECT version, applied_at FROM schema_version ORDER BY version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var applied int64
+		if err := rows.Scan(&version, &applied); err != nil {
+			return nil, err
+		}
+		if version >= 1 && version <= len(states) {
+			states[version-1].AppliedAt = time.UnixMilli(applied)
+		}
+	}
+	return states, rows.Err()
+}
+
+// hasTable reports whether the database has a table.
+func (d *DataBase) hasTable(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, table string) (bool, error) {
+	var n int
+	err := q.QueryRowContext(ctx, d.dialect.rebind(d.dialect.hasTable), table).Scan(&n)
+	return n > 0, err
+}
@@ -0,0 +1,110 @@
+-- The schema as it was before migrations were versioned. It is idempotent so
+-- that databases created by earlier versions can adopt it.
+
+CREATE TABLE IF NOT EXISTS users (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    login TEXT NOT NULL UNIQUE,
+    password TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS expressions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    expression TEXT NOT NULL,
+    status TEXT NOT NULL,
+    result REAL,
+    created_at INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    expression_id INTEGER NOT NULL,
+    arg1 REAL NOT NULL,
+    arg2 REAL NOT NULL,
+    operation TEXT NOT NULL,
+    operation_time INTEGER NOT NULL,
+    completed BOOLEAN DEFAULT FALSE,
+    result REAL,
+    FOREIGN KEY(expression_id) REFERENCES expressions(id)
+);
+
+CREATE TABLE IF NOT EXISTS batches (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    created_at INTEGER NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS batch_expressions (
+    batch_id INTEGER NOT NULL,
+    expression_id INTEGER NOT NULL,
+    position INTEGER NOT NULL,
+    PRIMARY KEY(batch_id, expression_id),
+    FOREIGN KEY(batch_id) REFERENCES batches(id),
+    FOREIGN KEY(expression_id) REFERENCES expressions(id)
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id INTEGER NOT NULL,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    response TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY(user_id, key),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    user_id INTEGER PRIMARY KEY,
+    url TEXT NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    expression_id INTEGER NOT NULL,
+    url TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at INTEGER NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    response_code INTEGER NOT NULL DEFAULT 0,
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL,
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(expression_id) REFERENCES expressions(id)
+);
+
+CREATE TABLE IF NOT EXISTS import_jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    filename TEXT NOT NULL,
+    format TEXT NOT NULL,
+    status TEXT NOT NULL,
+    total INTEGER NOT NULL DEFAULT 0,
+    accepted INTEGER NOT NULL DEFAULT 0,
+    rejected INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created_at INTEGER NOT NULL,
+    finished_at INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+
+CREATE TABLE IF NOT EXISTS import_lines (
+    job_id INTEGER NOT NULL,
+    line INTEGER NOT NULL,
+    expression_id INTEGER,
+    error TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY(job_id, line),
+    FOREIGN KEY(job_id) REFERENCES import_jobs(id)
+);
+
+CREATE INDEX IF NOT EXISTS expressions_user_id ON expressions(user_id, id);
+CREATE INDEX IF NOT EXISTS expressions_user_created ON expressions(user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS expressions_user_status ON expressions(user_id, status, id);
@@ -0,0 +1,4 @@
+-- Webhook deliveries are polled by status and next attempt and listed per user.
+CREATE INDEX webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at, id);
+CREATE INDEX webhook_deliveries_user ON webhook_deliveries(user_id, id);
+CREATE INDEX import_jobs_user ON import_jobs(user_id, id);
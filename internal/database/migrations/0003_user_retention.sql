@@ -0,0 +1,3 @@
+-- Users may override the retention policy. NULL falls back to the global one.
+ALTER TABLE users ADD COLUMN retention_max_age_ms INTEGER;
+ALTER TABLE users ADD COLUMN retention_max_count INTEGER;
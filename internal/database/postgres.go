@@ -0,0 +1,34 @@
+package database
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var postgresDialect = &dialect{
+	driver:   "postgres",
+	numbered: true,
+	// Times are Unix milliseconds and results need double precision.
+	types: strings.NewReplacer(
+		"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+		"INTEGER", "BIGINT",
+		"REAL", "DOUBLE PRECISION",
+	),
+	like:     "ILIKE",
+	hasTable: `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`,
+	violation: func(err error) constraint {
+		var e *pq.Error
+		if !errors.As(err, &e) {
+			return noConstraint
+		}
+		switch e.Code {
+		case "23505":
+			return uniqueConstraint
+		case "23503":
+			return foreignKeyConstraint
+		}
+		return noConstraint
+	},
+}
@@ -0,0 +1,158 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// finishedStatus is the condition of expressions that will not change any more.
+const finishedStatus = effectiveStatus + ` IN ('completed', 'error', 'cancelled')`
+
+// DeleteExpression removes an expression of the user together with its tasks,
+// batch membership and webhook deliveries.
+func (d *DataBase) DeleteExpression(ctx context.Context, id, userID int) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	ids, err := d.deleteExpressions(ctx, `id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteExpressions removes the finished expressions of the user that match
+// the filter and returns their IDs.
+func (d *DataBase) DeleteExpressions(ctx context.Context, userID int, f ExpressionFilter) ([]int, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	where, args := f.where(d.dialect, userID)
+	where = append(where, finishedStatus)
+	return d.deleteExpressions(ctx, strings.Join(where, " AND "), args...)
+}
+
+// Retention is the retention policy of a user. A nil limit falls back to the
+// global one and a zero limit disables it.
+type Retention struct {
+	MaxAge   *int `json:"max_age_ms"`
+	MaxCount *int `json:"max_count"`
+}
+
+// SetRetention stores the retention policy of a user.
+func (d *DataBase) SetRetention(ctx context.Context, userID int, r Retention) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	result, err := d.exec(ctx,
+		`UPDATE users SET retention_max_age_ms = ?, retention_max_count = ? WHERE id = ?`,
+		nullInt(r.MaxAge), nullInt(r.MaxCount), userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// GetRetention returns the retention policy of a user.
+func (d *DataBase) GetRetention(ctx context.Context, userID int) (Retention, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	var age, count sql.NullInt64
+	err := d.queryRow(ctx,
+		`SELECT retention_max_age_ms, retention_max_count FROM users WHERE id = ?`, userID,
+	).Scan(&age, &count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Retention{}, ErrUnknownUser
+	}
+	if err != nil {
+		return Retention{}, err
+	}
+	return Retention{MaxAge: intOrNil(age), MaxCount: intOrNil(count)}, nil
+}
+
+func nullInt(v *int) sql.NullInt64 {
+	if v == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*v), Valid: true}
+}
+
+func intOrNil(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	n := int(v.Int64)
+	return &n
+}
+
+// PurgeExpressions removes finished expressions older than maxAge and those
+// beyond the keep most recent expressions of their user. The retention policy
+// of a user overrides both limits, and a zero limit is disabled. It returns
+// the IDs of the removed expressions.
+func (d *DataBase) PurgeExpressions(ctx context.Context, now time.Time, maxAge time.Duration, keep int) ([]int, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	ageMs := maxAge.Milliseconds()
+	return d.deleteExpressions(ctx, finishedStatus+` AND (
+		id IN (
+			SELECT e.id FROM expressions e JOIN users u ON u.id = e.user_id
+			WHERE COALESCE(u.retention_max_age_ms, ?) > 0
+			AND e.created_at < ? - COALESCE(u.retention_max_age_ms, ?))
+		OR id IN (
+			SELECT ranked.id FROM (
+				SELECT id, user_id, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY id DESC) AS n
+				FROM expressions
+			) AS ranked JOIN users u ON u.id = ranked.user_id
+			WHERE COALESCE(u.retention_max_count, ?) > 0
+			AND ranked.n > COALESCE(u.retention_max_count, ?)))`,
+		ageMs, now.UnixMilli(), ageMs, keep, keep,
+	)
+}
+
+// deleteExpressions removes the expressions matching the condition and the
+// rows referencing them in one transaction.
+func (d *DataBase) deleteExpressions(ctx context.Context, cond string, args ...interface{}) ([]int, error) {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	selected := `SELECT id FROM expressions WHERE ` + cond
+	for _, table := range []string{"tasks", "batch_expressions", "webhook_deliveries"} {
+		if _, err := tx.ExecContext(ctx, d.dialect.rebind(`DELETE FROM `+table+` WHERE expression_id IN (`+selected+`)`), args...); err != nil {
+			return nil, err
+		}
+	}
+	rows, err := tx.QueryContext(ctx, d.dialect.rebind(`DELETE FROM expressions WHERE `+cond+` RETURNING id`), args...)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+func scanIDs(rows *sql.Rows) ([]int, error) {
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
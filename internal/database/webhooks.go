@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Delivery is a webhook notification about a finished expression together
+// with the state of its delivery. Times are stored as Unix milliseconds.
+type Delivery struct {
+	ID           int       `json:"id"`
+	UserID       int       `json:"-"`
+	ExpressionID int       `json:"expression_id"`
+	URL          string    `json:"url"`
+	Payload      string    `json:"-"`
+	Status       string    `json:"status"`
+	Attempts     int       `json:"attempts"`
+	NextAttempt  time.Time `json:"next_attempt_at"`
+	LastError    string    `json:"last_error,omitempty"`
+	ResponseCode int       `json:"response_code,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+const deliveryColumns = `id, user_id, expression_id, url, payload, status, attempts,
+	next_attempt_at, last_error, response_code, created_at, updated_at`
+
+// SetWebhook sets the default callback URL of a user. An empty URL removes it.
+func (d *DataBase) SetWebhook(ctx context.Context, userID int, url string) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	if url == "" {
+		_, err := d.exec(ctx, `DELETE FROM webhooks WHERE user_id = ?`, userID)
+		return err
+	}
+	_, err := d.exec(ctx,
+		`INSERT INTO webhooks (user_id, url) VALUES (?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET url = excluded.url`,
+		userID, url,
+	)
+	return d.userError(err)
+}
+
+// GetWebhook returns the default callback URL of a user, or "" if there is none.
+func (d *DataBase) GetWebhook(ctx context.Context, userID int) (string, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	var url string
+	err := d.queryRow(ctx, `SELECT url FROM webhooks WHERE user_id = ?`, userID).Scan(&url)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return url, err
+}
+
+func (d *DataBase) CreateDelivery(ctx context.Context, dl *Delivery) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	return d.queryRow(ctx,
+		`INSERT INTO webhook_deliveries
+		(user_id, expression_id, url, payload, status, attempts, next_attempt_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id`,
+		dl.UserID, dl.ExpressionID, dl.URL, dl.Payload, dl.Status, dl.Attempts,
+		dl.NextAttempt.UnixMilli(), dl.CreatedAt.UnixMilli(), dl.UpdatedAt.UnixMilli(),
+	).Scan(&dl.ID)
+}
+
+func (d *DataBase) UpdateDelivery(ctx context.Context, dl *Delivery) error {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	_, err := d.exec(ctx,
+		`UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, response_code = ?, updated_at = ?
+		WHERE id = ?`,
+		dl.Status, dl.Attempts, dl.NextAttempt.UnixMilli(), dl.LastError, dl.ResponseCode, dl.UpdatedAt.UnixMilli(),
+		dl.ID,
+	)
+	return err
+}
+
+// DueDeliveries returns up to limit pending deliveries whose next attempt is
+// not after now, oldest first.
+func (d *DataBase) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]*Delivery, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	return d.queryDeliveries(ctx,
+		`SELECT `+deliveryColumns+` FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= ?
+		ORDER BY next_attempt_at, id LIMIT ?`,
+		now.UnixMilli(), limit,
+	)
+}
+
+// GetDeliveries returns the delivery log of a user, newest first.
+func (d *DataBase) GetDeliveries(ctx context.Context, userID, limit int) ([]*Delivery, error) {
+	ctx, cancel := d.context(ctx)
+	defer cancel()
+	return d.queryDeliveries(ctx,
+		`SELECT `+deliveryColumns+` FROM webhook_deliveries
+		WHERE user_id = ? ORDER BY id DESC LIMIT ?`,
+		userID, limit,
+	)
+}
+
+func (d *DataBase) queryDeliveries(ctx context.Context, query string, args ...interface{}) ([]*Delivery, error) {
+	rows, err := d.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*Delivery{}
+	for rows.Next() {
+		dl := &Delivery{}
+		var next, created, updated int64
+		err := rows.Scan(&dl.ID, &dl.UserID, &dl.ExpressionID, &dl.URL, &dl.Payload, &dl.Status, &dl.Attempts,
+			&next, &dl.LastError, &dl.ResponseCode, &created, &updated)
+		if err != nil {
+			return nil, err
+		}
+		dl.NextAttempt = time.UnixMilli(next)
+		dl.CreatedAt = time.UnixMilli(created)
+		dl.UpdatedAt = time.UnixMilli(updated)
+		deliveries = append(deliveries, dl)
+	}
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,276 @@
+package orchestrator
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type AgentInfo struct {
+	ID             string    `json:"id"`
+	Hostname       string    `json:"hostname"`
+	ComputingPower int       `json:"computing_power"`
+	Operations     []string  `json:"operations"`
+	Version        string    `json:"version"`
+	RegisteredAt   time.Time `json:"registered_at"`
+	LastHeartbeat  time.Time `json:"last_heartbeat"`
+	CompletedTasks int       `json:"completed_tasks"`
+
+	// secret is issued on registration and proves the agent's ID on every
+	// later call.
+	secret string
+	// token is the agent token the agent registered with.
+	token string
+}
+
+type agentStatus struct {
+	*AgentInfo
+	InFlight   []string    `json:"in_flight"`
+	Throughput float64     `json:"throughput"`
+	Quarantine *quarantine `json:"quarantine,omitempty"`
+}
+
+var (
+	errUnknownAgent   = errors.New("unknown agent")
+	errAgentIDTaken   = errors.New("agent ID is taken")
+	errAgentSecret    = errors.New("invalid agent secret")
+	errAgentAnonymous = errors.New("agent must register")
+)
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// registerAgent adds the agent to the fleet or refreshes its registration and
+// returns the secret the agent has to present with its ID from now on. An ID
+// is generated when the agent did not provide one. The ID of a live agent can
+// only be registered again with that agent's secret, and no new ID is handed
+// out for the agent token of a quarantined agent, so it cannot register its
+// way out of the quarantine.
+func (o *Orchestrator) registerAgent(info AgentInfo, secret, token string) (*AgentInfo, string, error) {
+	if info.ID == "" {
+		info.ID = randomHex(8)
+	}
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if existing, ok := o.agents[info.ID]; ok {
+		if !existing.hasSecret(secret) {
+			log.Printf("Rejected registration of agent %s: the ID belongs to a live agent", info.ID)
+			return nil, "", errAgentIDTaken
+		}
+		info.RegisteredAt = existing.RegisteredAt
+		info.CompletedTasks = existing.CompletedTasks
+		info.secret = existing.secret
+		info.token = existing.token
+	} else {
+		for id, q := range o.quarantined {
+			if q.token != "" && subtle.ConstantTimeCompare([]byte(q.token), []byte(token)) == 1 {
+				log.Printf("Rejected registration of agent %s: its token belongs to quarantined agent %s", info.ID, id)
+				return nil, "", errAgentQuarantined
+			}
+		}
+		info.RegisteredAt = now
+		info.token = token
+		info.secret = randomHex(16)
+		log.Printf("Agent %s registered from %s with %d workers", info.ID, info.Hostname, info.ComputingPower)
+	}
+	info.LastHeartbeat = now
+	o.agents[info.ID] = &info
+	return &info, info.secret, nil
+}
+
+func (a *AgentInfo) hasSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(a.secret), []byte(secret)) == 1
+}
+
+// authenticate checks the secret a call came with against the agent ID it
+// claims. IDs that are not registered stay anonymous and need no secret, but
+// only as long as no agent registered and none is quarantined: otherwise a
+// quarantined agent could keep working by dropping its ID. It must be called
+// with o.mu held.
+func (o *Orchestrator) authenticate(agentID, secret string) error {
+	agent, ok := o.agents[agentID]
+	if !ok {
+		if len(o.agents) > 0 || len(o.quarantined) > 0 {
+			return errAgentAnonymous
+		}
+		return nil
+	}
+	if !agent.hasSecret(secret) {
+		return errAgentSecret
+	}
+	return nil
+}
+
+// operatorRequest reports whether r needs an operator token instead of an
+// agent token: agents must not release themselves from quarantine or see the
+// rest of the fleet.
+func operatorRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet && r.URL.Path == "/internal/agents" {
+		return true
+	}
+	return r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/quarantine")
+}
+
+func (o *Orchestrator) heartbeat(agentID, secret string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	agent, ok := o.agents[agentID]
+	if !ok {
+		return errUnknownAgent
+	}
+	if !agent.hasSecret(secret) {
+		return errAgentSecret
+	}
+	agent.LastHeartbeat = time.Now()
+	return nil
+}
+
+// expireAgents forgets agents that missed their heartbeats and immediately
+// returns the tasks they were holding to the queue. It must be called with
+// o.mu held.
+func (o *Orchestrator) expireAgents(now time.Time) {
+	timeout := time.Duration(o.Config.AgentTimeout) * time.Millisecond
+	for id, agent := range o.agents {
+		if now.Sub(agent.LastHeartbeat) <= timeout {
+			continue
+		}
+		delete(o.agents, id)
+		released := 0
+		for _, task := range o.leases {
+			if _, ok := task.leases[id]; ok {
+				o.releaseLease(task, id)
+				released++
+			}
+		}
+		log.Printf("Agent %s missed heartbeats, releasing %d tasks", id, released)
+	}
+}
+
+func (o *Orchestrator) agentStatuses() []agentStatus {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now()
+	statuses := make([]agentStatus, 0, len(o.agents))
+	for _, agent := range o.agents {
+		info := *agent
+		status := agentStatus{AgentInfo: &info, InFlight: []string{}}
+		if uptime := now.Sub(agent.RegisteredAt).Seconds(); uptime > 0 {
+			status.Throughput = float64(agent.CompletedTasks) / uptime
+		}
+		for id, task := range o.leases {
+			if _, ok := task.leases[agent.ID]; ok {
+				status.InFlight = append(status.InFlight, id)
+			}
+		}
+		if q, ok := o.quarantined[agent.ID]; ok {
+			status.Quarantine = &q
+		}
+		sort.Strings(status.InFlight)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// AgentsHandler serves GET /internal/agents (the fleet view) and
+// POST /internal/agents (registration).
+func (o *Orchestrator) AgentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"agents": o.agentStatuses()})
+	case http.MethodPost:
+		var info AgentInfo
+		if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, "Invalid Body")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		agent, secret, err := o.registerAgent(info, r.Header.Get("X-Agent-Secret"), token)
+		if errors.Is(err, errAgentQuarantined) {
+			writeError(w, http.StatusForbidden, "Agent token is quarantined")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusConflict, "Agent ID is taken")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":                    agent.ID,
+			"secret":                secret,
+			"heartbeat_interval_ms": o.Config.HeartbeatInterval,
+		})
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a POST or GET Method")
+	}
+}
+
+// AgentHandler routes the per-agent endpoints under /internal/agents/{id}/.
+func (o *Orchestrator) AgentHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/heartbeat"):
+		o.AgentHeartbeatHandler(w, r)
+	case strings.HasSuffix(r.URL.Path, "/quarantine"):
+		o.AgentQuarantineHandler(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// AgentQuarantineHandler serves DELETE /internal/agents/{id}/quarantine, which
+// lets a quarantined agent receive tasks again. It needs an operator token.
+func (o *Orchestrator) AgentQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a DELETE Method")
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/internal/agents/"), "/quarantine")
+	o.mu.Lock()
+	_, ok := o.quarantined[id]
+	delete(o.quarantined, id)
+	o.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Agent is not quarantined")
+		return
+	}
+	log.Printf("Agent %s released from quarantine", id)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"released"}`))
+}
+
+// AgentHeartbeatHandler serves POST /internal/agents/{id}/heartbeat.
+func (o *Orchestrator) AgentHeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method")
+		return
+	}
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/internal/agents/"), "/heartbeat")
+	if !ok || id == "" {
+		writeError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	err := o.heartbeat(id, r.Header.Get("X-Agent-Secret"))
+	if errors.Is(err, errAgentSecret) {
+		writeError(w, http.StatusForbidden, "Invalid agent secret")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, "Agent not registered")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ok"}`))
+}
@@ -0,0 +1,174 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+	"github.com/Rail-KH/Final_calc/pkg/calculation"
+)
+
+// maxBatchSize caps the number of expressions in one batch.
+const maxBatchSize = 1000
+
+// batchItem is the outcome of one expression of a batch: its ID or an error.
+type batchItem struct {
+	ID    string `json:"id,omitempty"`
+	Cache string `json:"cache,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// decodeBatchItem reads an item of a batch, either an expression string or an
+// object with the same fields as the body of /api/v1/calculate.
+func decodeBatchItem(raw json.RawMessage) (CalculateRequest, error) {
+	var in CalculateRequest
+	if err := json.Unmarshal(raw, &in.Expression); err == nil {
+		return in, nil
+	}
+	err := json.Unmarshal(raw, &in)
+	return in, err
+}
+
+// BatchHandler serves POST /api/v1/calculate/batch. Every expression is
+// validated on its own; the valid ones are stored in one transaction and
+// scheduled, the response lists an ID or an error per item.
+func (o *Orchestrator) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a POST Method")
+		return
+	}
+	var body struct {
+		Expressions []json.RawMessage `json:"expressions"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Expressions) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "Invalid Body")
+		return
+	}
+	if len(body.Expressions) > maxBatchSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("A batch may contain at most %d expressions", maxBatchSize))
+		return
+	}
+
+	items := make([]batchItem, len(body.Expressions))
+	var (
+		valid []int
+		reqs  []CalculateRequest
+		asts  []*calculation.Node
+		exprs []string
+	)
+	for i, raw := range body.Expressions {
+		in, err := decodeBatchItem(raw)
+		if err != nil {
+			items[i].Error = "Invalid Body"
+			continue
+		}
+		if err := o.validateRequest(r.Context(), userID, &in); err != nil {
+			var reqErr *requestError
+			if !errors.As(err, &reqErr) {
+				storageError(w, err, "Failed to create expressions")
+				return
+			}
+			items[i].Error = reqErr.msg
+			continue
+		}
+		ast, err := calculation.ParseASTWithVariables(in.Expression, in.Variables)
+		if err != nil {
+			items[i].Error = err.Error()
+			continue
+		}
+		valid = append(valid, i)
+		reqs = append(reqs, in)
+		asts = append(asts, ast)
+		exprs = append(exprs, in.Expression)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(valid) == 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "No valid expressions", "items": items})
+		return
+	}
+	batchID, ids, err := o.Database.CreateBatch(r.Context(), userID, exprs)
+	if err != nil {
+		storageError(w, err, "Failed to create expressions")
+		return
+	}
+	for j, i := range valid {
+		expr := newExpression(ids[j], userID, reqs[j], asts[j])
+		items[i].Cache = o.startExpression(expr)
+		items[i].ID = expr.ID
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"batch_id": strconv.Itoa(batchID), "items": items})
+}
+
+// BatchByIDHandler serves GET /api/v1/batches/{id}: the expressions of a batch
+// and how many of them are in each status.
+func (o *Orchestrator) BatchByIDHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method")
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/batches/"), ":"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid batch ID")
+		return
+	}
+	dbExprs, err := o.Database.GetBatch(r.Context(), id, userID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "Batch not found")
+			return
+		}
+		storageError(w, err, "Failed to get batch")
+		return
+	}
+
+	counts := make(map[string]int)
+	done := 0
+	exprs := make([]*Expression, 0, len(dbExprs))
+	for _, e := range dbExprs {
+		status := e.Status
+		if finished(e.Status, e.Result) {
+			done++
+		} else {
+			// Unfinished expressions may be stored as "completed" while
+			// their tasks run; report them as pending.
+			status = "pending"
+			if e.Status == "stuck" {
+				status = e.Status
+			}
+		}
+		counts[status]++
+		exprs = append(exprs, &Expression{ID: strconv.Itoa(e.ID), Expr: e.Expression, Status: status, Result: e.Result})
+	}
+	status := "running"
+	if done == len(exprs) {
+		status = "completed"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"batch": map[string]interface{}{
+			"id":          strconv.Itoa(id),
+			"status":      status,
+			"total":       len(exprs),
+			"done":        done,
+			"counts":      counts,
+			"expressions": exprs,
+		},
+	})
+}
@@ -0,0 +1,70 @@
+package orchestrator
+
+import (
+	"container/list"
+	"time"
+)
+
+// lruCache is a size-bounded cache that evicts the least recently used entry
+// and, when ttl is positive, drops entries older than ttl. A cache of size 0
+// stores nothing. It is not safe for concurrent use.
+type lruCache[K comparable, V any] struct {
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[K]*list.Element
+
+	hits, misses, evictions int64
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[K comparable, V any](size int, ttl time.Duration) *lruCache[K, V] {
+	return &lruCache[K, V]{size: size, ttl: ttl, order: list.New(), entries: make(map[K]*list.Element)}
+}
+
+func (c *lruCache[K, V]) get(key K, now time.Time) (V, bool) {
+	var zero V
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return zero, false
+	}
+	entry := el.Value.(*lruEntry[K, V])
+	if c.ttl > 0 && now.After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		c.misses++
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	c.hits++
+	return entry.value, true
+}
+
+func (c *lruCache[K, V]) put(key K, value V, now time.Time) {
+	if c.size <= 0 {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry[K, V])
+		entry.value, entry.expires = value, now.Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, expires: now.Add(c.ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[K, V]).key)
+		c.evictions++
+	}
+}
+
+func (c *lruCache[K, V]) len() int {
+	return c.order.Len()
+}
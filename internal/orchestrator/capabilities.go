@@ -0,0 +1,137 @@
+package orchestrator
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// parseOperations reads the comma separated ops parameter an agent sends with
+// GET /internal/task. It returns nil when the agent did not advertise any.
+func parseOperations(s string) []string {
+	var ops []string
+	for _, op := range strings.Split(s, ",") {
+		if op = strings.TrimSpace(op); op != "" {
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// supports reports whether an agent with the given operations can compute op.
+// An agent that advertises no operations is assumed to support all of them.
+func supports(ops []string, op string) bool {
+	if len(ops) == 0 {
+		return true
+	}
+	for _, o := range ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// operationsOf records the operations advertised by a registered agent and
+// returns the ones to match tasks against. It must be called with o.mu held.
+func (o *Orchestrator) operationsOf(agentID string, ops []string) []string {
+	agent, ok := o.agents[agentID]
+	if !ok {
+		return ops
+	}
+	if ops != nil {
+		agent.Operations = ops
+	}
+	return agent.Operations
+}
+
+// liveOperations returns the operations a live agent that is not quarantined
+// can compute, or all = true if one of them supports every operation. It must
+// be called with o.mu held.
+func (o *Orchestrator) liveOperations() (ops map[string]bool, all bool) {
+	ops = make(map[string]bool)
+	for id, agent := range o.agents {
+		if _, ok := o.quarantined[id]; ok {
+			continue
+		}
+		if len(agent.Operations) == 0 {
+			return nil, true
+		}
+		for _, op := range agent.Operations {
+			ops[op] = true
+		}
+	}
+	return ops, false
+}
+
+// stuckTask describes a queued task no live agent can compute.
+type stuckTask struct {
+	ID        string `json:"id"`
+	ExprID    string `json:"expression_id"`
+	Operation string `json:"operation"`
+}
+
+// markStuckTasks flags queued tasks that no live agent can compute and sets
+// the status of their expressions to "stuck". Expressions whose tasks became
+// computable again go back to "pending". Nothing is flagged while no agent is
+// registered or agents that did not register are polling, since they may
+// compute any operation. Only the expressions owning stuck tasks and those in
+// o.stuck are visited. It must be called with o.mu held.
+func (o *Orchestrator) markStuckTasks(now time.Time) {
+	timeout := time.Duration(o.Config.AgentTimeout) * time.Millisecond
+	known := len(o.agents) > 0 && now.Sub(o.anonymousPoll) > timeout
+	ops, all := o.liveOperations()
+	stuck := make(map[string]*Expression)
+	for _, task := range o.taskStore {
+		wasStuck := task.stuck
+		task.stuck = known && !all && task.queued && !ops[task.Operation]
+		if !task.stuck {
+			continue
+		}
+		if !wasStuck {
+			log.Printf("Task %s of expression %s is stuck: no live agent supports %q", task.ID, task.ExprID, task.Operation)
+		}
+		if expr, ok := o.exprStore[task.ExprID]; ok {
+			stuck[expr.ID] = expr
+			// Expressions sharing tasks are stuck together.
+			for _, follower := range expr.followers {
+				stuck[follower.ID] = follower
+			}
+		}
+	}
+	for id, expr := range stuck {
+		if (expr.Status == "pending" || expr.Status == "completed") && expr.Result == nil {
+			expr.Status = "stuck"
+			o.publishStatus(expr)
+			o.saveExpression(expr)
+		}
+		if expr.Status == "stuck" {
+			o.stuck[id] = expr
+		}
+	}
+	for id, expr := range o.stuck {
+		if _, ok := stuck[id]; ok {
+			continue
+		}
+		delete(o.stuck, id)
+		if expr.Status == "stuck" && o.exprStore[id] == expr {
+			expr.Status = "pending"
+			o.publishStatus(expr)
+			o.saveExpression(expr)
+		}
+	}
+}
+
+// stuckTasks lists the tasks flagged by markStuckTasks. It must be called with
+// o.mu held.
+func (o *Orchestrator) stuckTasks() []stuckTask {
+	tasks := []stuckTask{}
+	for _, task := range o.taskStore {
+		if task.stuck {
+			tasks = append(tasks, stuckTask{ID: task.ID, ExprID: task.ExprID, Operation: task.Operation})
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	return tasks
+}
@@ -0,0 +1,138 @@
+package orchestrator
+
+import (
+	"time"
+
+	"github.com/Rail-KH/Final_calc/pkg/calculation"
+)
+
+// evalMode identifies how tasks are evaluated. It is part of every cache key
+// so results of different modes never mix; float64 is the only mode so far.
+const evalMode = "float64"
+
+// Cache outcomes of a submission, reported in the "cache" field.
+const (
+	// cacheHit means the result was taken from the cache.
+	cacheHit = "hit"
+	// cacheShared means an identical expression is running and its tasks
+	// are shared.
+	cacheShared = "shared"
+	// cacheMiss means the expression is evaluated on its own.
+	cacheMiss = "miss"
+)
+
+// cachedResult is a cached result and the number of agents that verified it.
+type cachedResult struct {
+	Result   float64
+	Replicas int
+}
+
+// expressionKey addresses an expression by its canonical AST.
+func expressionKey(ast *calculation.Node) string {
+	return evalMode + ":" + calculation.Canonical(ast)
+}
+
+// startExpression makes an expression known to the orchestrator. It is
+// completed right away from the result cache, attached to a running identical
+// expression, or has its first tasks scheduled. Cached and shared results are
+// only used if they were verified by at least as many agents as requested.
+// It returns the cache outcome.
+func (o *Orchestrator) startExpression(expr *Expression) string {
+	defer o.flushWrites()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	expr.key = expressionKey(expr.AST)
+	if cached, ok := o.results.get(expr.key, time.Now()); ok && cached.Replicas >= expr.Replicas {
+		result := cached.Result
+		expr.Status = "completed"
+		expr.Result = &result
+		o.finishExpression(expr, "")
+		return cacheHit
+	}
+	o.exprStore[expr.ID] = expr
+	leader, running := o.inflight[expr.key]
+	if running && leader.Replicas >= expr.Replicas {
+		expr.leader = leader
+		leader.followers = append(leader.followers, expr)
+		return cacheShared
+	}
+	if !running {
+		o.inflight[expr.key] = expr
+	}
+	o.scheduleExpression(expr)
+	return cacheMiss
+}
+
+// finishExpression saves the final state of an expression and notifies its
+// subscribers and webhook. It must be called with o.mu held.
+func (o *Orchestrator) finishExpression(expr *Expression, errMsg string) {
+	if errMsg != "" {
+		o.events.publish(Event{Type: "done", ExprID: expr.ID, Status: expr.Status, Error: errMsg})
+	} else {
+		o.publishStatus(expr)
+	}
+	o.notifyWebhook(expr, errMsg)
+	o.saveExpression(expr)
+}
+
+// expressionDone caches the result of a finished expression and finishes the
+// identical expressions that shared its tasks. It must be called with o.mu
+// held.
+func (o *Orchestrator) expressionDone(expr *Expression, errMsg string) {
+	if o.inflight[expr.key] == expr {
+		delete(o.inflight, expr.key)
+	}
+	if expr.Status == "completed" && expr.Result != nil {
+		o.results.put(expr.key, cachedResult{Result: *expr.Result, Replicas: expr.Replicas}, time.Now())
+	}
+	for _, follower := range expr.followers {
+		follower.leader = nil
+		follower.Status = expr.Status
+		follower.Error = expr.Error
+		if expr.Result != nil {
+			result := *expr.Result
+			follower.Result = &result
+		}
+		o.finishExpression(follower, errMsg)
+	}
+	expr.followers = nil
+}
+
+// detachExpression removes a cancelled expression from task sharing. If other
+// expressions were waiting for it, the one requiring the most replicas takes
+// over and gets its tasks scheduled. It must be called with o.mu held.
+func (o *Orchestrator) detachExpression(expr *Expression) {
+	if leader := expr.leader; leader != nil {
+		for i, f := range leader.followers {
+			if f == expr {
+				leader.followers = append(leader.followers[:i], leader.followers[i+1:]...)
+				break
+			}
+		}
+		expr.leader = nil
+		return
+	}
+	if o.inflight[expr.key] != expr {
+		return
+	}
+	delete(o.inflight, expr.key)
+	if len(expr.followers) == 0 {
+		return
+	}
+	next := expr.followers[0]
+	for _, f := range expr.followers[1:] {
+		if f.Replicas > next.Replicas {
+			next = f
+		}
+	}
+	for _, f := range expr.followers {
+		if f != next {
+			f.leader = next
+			next.followers = append(next.followers, f)
+		}
+	}
+	next.leader = nil
+	expr.followers = nil
+	o.inflight[next.key] = next
+	o.scheduleExpression(next)
+}
@@ -0,0 +1,36 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+)
+
+// writeError writes an error response. Every error of the API has the same
+// body: {"error": msg}.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// storageError writes the response to a failed storage call: 401 if the user
+// of the token no longer exists, 504 if the query ran out of time, 503 if the
+// request was cancelled and 500 with msg otherwise. Missing records are
+// reported by the handlers, which know what was not found.
+func storageError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, database.ErrUnknownUser):
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, "Database timeout")
+	case errors.Is(err, context.Canceled):
+		writeError(w, http.StatusServiceUnavailable, "Request cancelled")
+	default:
+		writeError(w, http.StatusInternalServerError, msg)
+	}
+}
@@ -0,0 +1,221 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+)
+
+// eventBuffer is the number of events a subscriber may fall behind before it
+// is dropped.
+const eventBuffer = 256
+
+// sseKeepAlive is how often an idle event stream receives a comment so broken
+// connections are noticed.
+const sseKeepAlive = 15 * time.Second
+
+// Event describes progress of an expression.
+type Event struct {
+	// Type is one of "status", "task_scheduled", "task_completed" and "done".
+	Type      string   `json:"type"`
+	ExprID    string   `json:"expression_id"`
+	TaskID    string   `json:"task_id,omitempty"`
+	Operation string   `json:"operation,omitempty"`
+	Status    string   `json:"status,omitempty"`
+	Result    *float64 `json:"result,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// eventHub fans out expression events to the subscribers of each expression.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[string]map[chan Event]struct{})}
+}
+
+// subscribe returns a channel receiving the events of an expression and a
+// function that cancels the subscription. The channel is closed when the
+// subscriber falls too far behind.
+func (h *eventHub) subscribe(exprID string) (<-chan Event, func()) {
+	ch := make(chan Event, eventBuffer)
+	h.mu.Lock()
+	if h.subs[exprID] == nil {
+		h.subs[exprID] = make(map[chan Event]struct{})
+	}
+	h.subs[exprID][ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[exprID][ch]; ok {
+			h.drop(exprID, ch)
+		}
+	}
+}
+
+// drop removes a subscriber and closes its channel. It must be called with
+// h.mu held.
+func (h *eventHub) drop(exprID string, ch chan Event) {
+	delete(h.subs[exprID], ch)
+	if len(h.subs[exprID]) == 0 {
+		delete(h.subs, exprID)
+	}
+	close(ch)
+}
+
+// publish sends an event to the subscribers of its expression without
+// blocking.
+func (h *eventHub) publish(ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[ev.ExprID] {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("Dropping slow subscriber of expression %s", ev.ExprID)
+			h.drop(ev.ExprID, ch)
+		}
+	}
+}
+
+// publishStatus sends the current status of an expression, or a final "done"
+// event once it has finished.
+func (o *Orchestrator) publishStatus(expr *Expression) {
+	ev := Event{Type: "status", ExprID: expr.ID, Status: expr.Status, Result: expr.Result}
+	if finished(expr.Status, expr.Result) {
+		ev.Type = "done"
+	}
+	o.events.publish(ev)
+}
+
+// finished reports whether an expression with this status and result will not
+// change any more.
+func finished(status string, result *float64) bool {
+	return status == "error" || status == "cancelled" || (status == "completed" && result != nil)
+}
+
+// acceptsQueryToken reports whether the JWT may be passed as the token query
+// parameter, for clients such as EventSource and browser WebSockets that
+// cannot set headers.
+func acceptsQueryToken(path string) bool {
+	if path == "/api/v1/ws" {
+		return true
+	}
+	return strings.HasPrefix(path, "/api/v1/expressions/") && strings.HasSuffix(path, "/events")
+}
+
+// expressionID extracts the expression ID from /api/v1/expressions/{id}[suffix].
+// The ID may be prefixed with ':' as in the documented /api/v1/expressions/:id.
+func expressionID(path, suffix string) (int, error) {
+	id := strings.TrimSuffix(strings.TrimPrefix(path, "/api/v1/expressions/"), suffix)
+	return strconv.Atoi(strings.TrimPrefix(id, ":"))
+}
+
+// ExpressionEventsHandler serves GET /api/v1/expressions/{id}/events as a
+// Server-Sent Events stream. The first event carries the current status; the
+// stream ends after the "done" event or when the client disconnects. The
+// stream of an expression that is no longer computed, e.g. after a restart,
+// ends after its stored state.
+func (o *Orchestrator) ExpressionEventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method")
+		return
+	}
+	id, err := expressionID(r.URL.Path, "/events")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid expression ID")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	// Check ownership before subscribing to the events of the expression.
+	dbExpr, err := o.Database.GetExpressionByID(r.Context(), id, userID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "Expression not found")
+			return
+		}
+		storageError(w, err, "Failed to get expression")
+		return
+	}
+
+	// Subscribe before reading the current state so no event is lost in between.
+	exprID := strconv.Itoa(id)
+	events, cancel := o.events.subscribe(exprID)
+	defer cancel()
+	current := Event{Type: "status", ExprID: exprID, Status: dbExpr.Status, Result: dbExpr.Result}
+	o.mu.Lock()
+	expr, live := o.exprStore[exprID]
+	if live {
+		current.Status, current.Result = expr.Status, expr.Result
+	}
+	o.mu.Unlock()
+	if !live {
+		// The expression may have finished since it was read.
+		if dbExpr, err = o.Database.GetExpressionByID(r.Context(), id, userID); err != nil {
+			storageError(w, err, "Failed to get expression")
+			return
+		}
+		current.Status, current.Result = dbExpr.Status, dbExpr.Result
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev Event) error {
+		data, _ := json.Marshal(ev)
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if finished(current.Status, current.Result) {
+		current.Type = "done"
+	}
+	// An unfinished expression the orchestrator does not compute, e.g. after
+	// a restart, gets no more events.
+	if send(current) != nil || current.Type == "done" || !live {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok || send(ev) != nil || ev.Type == "done" {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
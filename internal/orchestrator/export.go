@@ -0,0 +1,149 @@
+package orchestrator
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+)
+
+// exportFlushRows is how many rows are written between flushes of an export.
+const exportFlushRows = 100
+
+// formulaPrefixes start the CSV cells that spreadsheets run as formulas.
+// A leading + or - is left alone: it starts valid expressions such as -5+3,
+// which a spreadsheet only evaluates to the same number.
+const formulaPrefixes = "=@\t\r"
+
+// exportColumns are the CSV columns of an export.
+var exportColumns = []string{"id", "expression", "status", "result", "error", "created_at", "updated_at"}
+
+// exportRow is a line of a JSON Lines export.
+type exportRow struct {
+	ID         string     `json:"id"`
+	Expression string     `json:"expression"`
+	Status     string     `json:"status"`
+	Result     *float64   `json:"result"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
+
+// ExportHandler serves GET /api/v1/expressions/export?format=csv|jsonl. It
+// streams the expressions of the user matching the filters of the expression
+// list, oldest first, as they are read from the database. Rows are buffered
+// until the first flush, so a database that fails early gets an error
+// response instead of an empty export.
+func (o *Orchestrator) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a GET Method")
+		return
+	}
+	filter, err := expressionFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	var (
+		body  bytes.Buffer
+		write func(e *database.Expression) error
+		flush = func() {}
+	)
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(&body)
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		cw.Write(exportColumns)
+		write = func(e *database.Expression) error {
+			result := ""
+			if e.Result != nil {
+				result = strconv.FormatFloat(*e.Result, 'g', -1, 64)
+			}
+			return cw.Write([]string{
+				strconv.Itoa(e.ID), csvText(e.Expression), e.Status, result, csvText(e.Error),
+				exportTime(e.CreatedAt), exportTime(e.UpdatedAt),
+			})
+		}
+		flush = cw.Flush
+	case "jsonl":
+		enc := json.NewEncoder(&body)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		write = func(e *database.Expression) error {
+			return enc.Encode(exportRow{
+				ID:         strconv.Itoa(e.ID),
+				Expression: e.Expression,
+				Status:     e.Status,
+				Result:     e.Result,
+				Error:      e.Error,
+				CreatedAt:  createdAt(e.CreatedAt),
+				UpdatedAt:  createdAt(e.UpdatedAt),
+			})
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "format must be csv or jsonl")
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="expressions.`+format+`"`)
+
+	flusher, _ := w.(http.Flusher)
+	rows, sent := 0, false
+	send := func() {
+		flush()
+		w.Write(body.Bytes())
+		body.Reset()
+		sent = true
+	}
+	err = o.Database.ExportExpressions(r.Context(), userID, filter, func(e *database.Expression) error {
+		if err := write(e); err != nil {
+			return err
+		}
+		if rows++; rows%exportFlushRows == 0 && flusher != nil {
+			send()
+			flusher.Flush()
+		}
+		return nil
+	})
+	switch {
+	case err == nil:
+		send()
+	case !sent:
+		w.Header().Del("Content-Disposition")
+		storageError(w, err, "Failed to export expressions")
+	default:
+		// The status is already sent; the truncated body is all we can report.
+		log.Printf("Export of user %d failed after %d rows: %v", userID, rows, err)
+	}
+}
+
+// csvText keeps a spreadsheet from running a CSV cell as a formula by
+// prefixing it with a quote.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune(formulaPrefixes, rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// exportTime formats a time of an export, or "" if it is unknown.
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
@@ -0,0 +1,259 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/agentpb"
+	"github.com/Rail-KH/Final_calc/internal/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type grpcServer struct {
+	agentpb.UnimplementedAgentServiceServer
+	o *Orchestrator
+}
+
+// RunGRPCServer serves the agent protocol over gRPC on Config.GRPCAddr.
+// The HTTP endpoints under /internal stay available as a fallback.
+func (o *Orchestrator) RunGRPCServer() error {
+	lis, err := net.Listen("tcp", ":"+o.Config.GRPCAddr)
+	if err != nil {
+		return err
+	}
+	return o.GRPCServer().Serve(lis)
+}
+
+// GRPCServer returns a gRPC server with the agent service registered.
+// Every call must carry one of Config.AgentTokens in the "authorization"
+// metadata key.
+func (o *Orchestrator) GRPCServer() *grpc.Server {
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := o.checkAgentToken(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := o.checkAgentToken(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	agentpb.RegisterAgentServiceServer(s, &grpcServer{o: o})
+	return s
+}
+
+func (o *Orchestrator) checkAgentToken(ctx context.Context, method string) error {
+	if !auth.CheckAgentToken(agentToken(ctx), o.Config.AgentTokens) {
+		var addr string
+		if p, ok := peer.FromContext(ctx); ok {
+			addr = p.Addr.String()
+		}
+		log.Printf("Rejected agent call %s from %s: invalid agent token", method, addr)
+		return status.Error(codes.Unauthenticated, "invalid agent token")
+	}
+	return nil
+}
+
+// agentToken returns the agent token the call came with in the
+// "authorization" metadata key.
+func agentToken(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		return strings.TrimPrefix(md.Get("authorization")[0], "Bearer ")
+	}
+	return ""
+}
+
+// agentSecret returns the secret the calling agent sent in the "agent-secret"
+// metadata key.
+func agentSecret(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("agent-secret")) > 0 {
+		return md.Get("agent-secret")[0]
+	}
+	return ""
+}
+
+func (s *grpcServer) Register(ctx context.Context, req *agentpb.RegisterRequest) (*agentpb.RegisterResponse, error) {
+	agent, secret, err := s.o.registerAgent(AgentInfo{
+		ID:             req.AgentId,
+		Hostname:       req.Hostname,
+		ComputingPower: int(req.ComputingPower),
+		Operations:     req.Operations,
+		Version:        req.Version,
+	}, agentSecret(ctx), agentToken(ctx))
+	if errors.Is(err, errAgentQuarantined) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	}
+	return &agentpb.RegisterResponse{
+		AgentId:             agent.ID,
+		HeartbeatIntervalMs: int64(s.o.Config.HeartbeatInterval),
+		AgentSecret:         secret,
+	}, nil
+}
+
+func (s *grpcServer) FetchTasks(ctx context.Context, req *agentpb.FetchTasksRequest) (*agentpb.FetchTasksResponse, error) {
+	limit := int(req.MaxTasks)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > maxTaskBatch {
+		limit = maxTaskBatch
+	}
+	wait := time.Duration(req.WaitMs) * time.Millisecond
+	if wait > maxTaskWait {
+		wait = maxTaskWait
+	}
+	tasks, err := s.o.leaseTasks(ctx, req.AgentId, agentSecret(ctx), req.Operations, limit, wait)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	resp := &agentpb.FetchTasksResponse{}
+	for _, task := range tasks {
+		resp.Tasks = append(resp.Tasks, taskToProto(task))
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) SubmitResult(ctx context.Context, req *agentpb.SubmitResultRequest) (*agentpb.SubmitResultResponse, error) {
+	results := make([]TaskResult, len(req.Results))
+	for i, res := range req.Results {
+		results[i] = resultFromProto(res)
+	}
+	statuses, err := s.o.submitResults(req.AgentId, agentSecret(ctx), results)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	resp := &agentpb.SubmitResultResponse{}
+	for i, status := range statuses {
+		resp.Statuses = append(resp.Statuses, &agentpb.ResultStatus{Id: results[i].ID, Status: status})
+	}
+	return resp, nil
+}
+
+func (s *grpcServer) Heartbeat(ctx context.Context, req *agentpb.HeartbeatRequest) (*agentpb.HeartbeatResponse, error) {
+	err := s.o.heartbeat(req.AgentId, agentSecret(ctx))
+	if errors.Is(err, errAgentSecret) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	s.o.mu.Lock()
+	defer s.o.mu.Unlock()
+	return &agentpb.HeartbeatResponse{QueuedTasks: int32(s.o.TaskQueue.Len())}, nil
+}
+
+// Connect pushes tasks to the agent as long as it has announced free capacity
+// through credits, and applies the results it streams back.
+func (s *grpcServer) Connect(stream agentpb.AgentService_ConnectServer) error {
+	ctx := stream.Context()
+	var agentID string
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("agent-id")) > 0 {
+		agentID = md.Get("agent-id")[0]
+	}
+	secret := agentSecret(ctx)
+	var sendMu sync.Mutex
+	send := func(msg *agentpb.OrchestratorMessage) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(msg)
+	}
+
+	var credits atomic.Int64
+	wake := make(chan struct{}, 1)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			switch p := msg.Payload.(type) {
+			case *agentpb.AgentMessage_Credits:
+				credits.Add(int64(p.Credits))
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			case *agentpb.AgentMessage_Result:
+				res := resultFromProto(p.Result)
+				statuses, err := s.o.submitResults(agentID, secret, []TaskResult{res})
+				if err != nil {
+					errc <- status.Error(codes.PermissionDenied, err.Error())
+					return
+				}
+				err = send(&agentpb.OrchestratorMessage{
+					Payload: &agentpb.OrchestratorMessage_Status{Status: &agentpb.ResultStatus{Id: res.ID, Status: statuses[0]}},
+				})
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		available := int(credits.Load())
+		if available <= 0 {
+			select {
+			case <-wake:
+			case err := <-errc:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		tasks, err := s.o.leaseTasks(ctx, agentID, secret, nil, min(available, maxTaskBatch), maxTaskWait)
+		if err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		for _, task := range tasks {
+			err := send(&agentpb.OrchestratorMessage{
+				Payload: &agentpb.OrchestratorMessage_Task{Task: taskToProto(task)},
+			})
+			if err != nil {
+				log.Printf("Failed to push task %s: %v", task.ID, err)
+				return err
+			}
+			credits.Add(-1)
+		}
+		select {
+		case err := <-errc:
+			return err
+		default:
+		}
+	}
+}
+
+func taskToProto(t *Task) *agentpb.Task {
+	return &agentpb.Task{
+		Id:            t.ID,
+		Arg1:          t.Arg1,
+		Arg2:          t.Arg2,
+		Operation:     t.Operation,
+		OperationTime: int32(t.OperationTime),
+	}
+}
+
+func resultFromProto(r *agentpb.TaskResult) TaskResult {
+	return TaskResult{ID: r.Id, Result: r.Result, Error: r.Error}
+}
@@ -0,0 +1,111 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxIdempotencyKey caps the length of an Idempotency-Key header.
+	maxIdempotencyKey = 255
+	// maxIdempotentBody caps the size of a request body read to be hashed.
+	maxIdempotentBody = 1 << 20
+)
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// withIdempotency makes POST requests carrying an Idempotency-Key header safe
+// to retry: the first response for a key of the user is stored for
+// Config.IdempotencyTTL milliseconds and replayed for later requests with the
+// same key instead of calling next again. Server errors are not stored, and
+// bodies over maxIdempotentBody bytes are rejected. A key
+// whose request has not answered within Config.IdempotencyLease milliseconds,
+// e.g. because the orchestrator crashed, may be used again.
+func (o *Orchestrator) withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		userID, ok := r.Context().Value(req).(int)
+		if key == "" || !ok || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "Request body is too large")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid Body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+
+		now := time.Now()
+		ttl := time.Duration(o.Config.IdempotencyTTL) * time.Millisecond
+		lease := time.Duration(o.Config.IdempotencyLease) * time.Millisecond
+		stored, err := o.Database.ReserveIdempotencyKey(r.Context(), userID, key, hash, now, now.Add(-ttl), now.Add(-lease))
+		if err != nil {
+			storageError(w, err, "Failed to check Idempotency-Key")
+			return
+		}
+		if stored != nil {
+			switch {
+			case stored.RequestHash != hash:
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was used with a different request")
+			case stored.StatusCode == 0:
+				writeError(w, http.StatusConflict, "A request with this Idempotency-Key is in progress")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				io.WriteString(w, stored.Body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+		// The key must be released or completed even if the client is gone.
+		ctx := context.WithoutCancel(r.Context())
+		if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+			err = o.Database.DeleteIdempotencyKey(ctx, userID, key, now)
+		} else {
+			err = o.Database.SaveIdempotentResponse(ctx, userID, key, now, rec.status, rec.body.String())
+		}
+		if err != nil {
+			log.Printf("Failed to store response for Idempotency-Key %q of user %d: %v", key, userID, err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package orchestrator
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+	"github.com/Rail-KH/Final_calc/pkg/calculation"
+)
+
+const (
+	// maxImportLines caps the number of lines of an upload.
+	maxImportLines = 100000
+	// maxImportLineLength caps the length of a line of a JSON Lines upload
+	// in bytes.
+	maxImportLineLength = 64 * 1024
+	// importChunk is how many line outcomes are stored at once.
+	importChunk = 100
+)
+
+// importItem is a non-empty line of an upload. err is set for a line that
+// could not be decoded.
+type importItem struct {
+	line int
+	in   CalculateRequest
+	err  error
+}
+
+// importReader returns the next line of an upload, io.EOF at its end or
+// another error if the upload cannot be read further.
+type importReader func() (importItem, error)
+
+// csvImport reads lines of the form expression,name=value,... An optional
+// first line with an "expression" column is a header. The expression is then
+// read from that column and the other named columns are skipped, except
+// "variables", so an export can be imported back as it is.
+func csvImport(r io.Reader) importReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	column, skip := 0, map[int]bool{}
+	return func() (importItem, error) {
+		for {
+			record, err := cr.Read()
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return importItem{line: parseErr.StartLine, err: &requestError{"invalid CSV line"}}, nil
+			}
+			if err != nil {
+				return importItem{}, err
+			}
+			line, _ := cr.FieldPos(0)
+			if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+				continue
+			}
+			if line == 1 && csvHeader(record, &column, skip) {
+				continue
+			}
+			item := importItem{line: line}
+			if column < len(record) {
+				item.in.Expression = csvUnquote(record[column])
+			}
+			for i, field := range record {
+				if i == column || skip[i] || strings.TrimSpace(field) == "" {
+					continue
+				}
+				name, value, found := strings.Cut(field, "=")
+				v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if !found || err != nil {
+					item.err = &requestError{fmt.Sprintf("invalid variable %q", field)}
+					break
+				}
+				if item.in.Variables == nil {
+					item.in.Variables = make(map[string]float64)
+				}
+				item.in.Variables[strings.TrimSpace(name)] = v
+			}
+			return item, nil
+		}
+	}
+}
+
+// csvHeader reports whether record is a header. If it is, it stores the
+// index of the expression column in column and marks the columns that hold
+// neither the expression nor variables in skip.
+func csvHeader(record []string, column *int, skip map[int]bool) bool {
+	found := false
+	for i, field := range record {
+		switch strings.ToLower(strings.TrimSpace(field)) {
+		case "expression":
+			if found {
+				skip[i] = true
+			} else {
+				*column, found = i, true
+			}
+		case "variables", "":
+		default:
+			skip[i] = true
+		}
+	}
+	if !found {
+		clear(skip)
+	}
+	return found
+}
+
+// csvUnquote removes the quote that csvText puts before a formula.
+func csvUnquote(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune(formulaPrefixes, rune(s[1])) {
+		return s[1:]
+	}
+	return s
+}
+
+// jsonlImport reads lines holding an expression string or an object with the
+// fields of the body of /api/v1/calculate.
+func jsonlImport(r io.Reader) importReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxImportLineLength)
+	line := 0
+	return func() (importItem, error) {
+		for scanner.Scan() {
+			line++
+			raw := strings.TrimSpace(scanner.Text())
+			if raw == "" {
+				continue
+			}
+			in, err := decodeBatchItem(json.RawMessage(raw))
+			if err != nil {
+				return importItem{line: line, err: &requestError{"invalid JSON line"}}, nil
+			}
+			return importItem{line: line, in: in}, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return importItem{}, fmt.Errorf("line %d: %w", line+1, err)
+		}
+		return importItem{}, io.EOF
+	}
+}
+
+// importFormat picks the format of an upload from the format parameter or
+// the file name.
+func importFormat(format, filename string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(path.Ext(filename)) {
+		case ".jsonl", ".ndjson":
+			format = "jsonl"
+		default:
+			format = "csv"
+		}
+	}
+	if format != "csv" && format != "jsonl" {
+		return "", errors.New("format must be csv or jsonl")
+	}
+	return format, nil
+}
+
+// ImportHandler serves POST /api/v1/expressions/import: a multipart upload
+// whose "file" part holds one expression per line. The file is read line by
+// line; valid expressions are scheduled right away and the outcome of every
+// line is stored in an import job.
+func (o *Orchestrator) ImportHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a POST Method")
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Expected a multipart/form-data upload")
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "The upload has no file part")
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+		format, err := importFormat(r.URL.Query().Get("format"), part.FileName())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		job := &database.ImportJob{
+			UserID:    userID,
+			Filename:  part.FileName(),
+			Format:    format,
+			Status:    "running",
+			CreatedAt: time.Now(),
+		}
+		if err := o.Database.CreateImportJob(r.Context(), job); err != nil {
+			storageError(w, err, "Failed to create import job")
+			return
+		}
+		next := csvImport(part)
+		if format == "jsonl" {
+			next = jsonlImport(part)
+		}
+		if err := o.importExpressions(r.Context(), job, next); err != nil {
+			log.Printf("Import job %d failed: %v", job.ID, err)
+			storageError(w, err, "Failed to import expressions")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"job": job})
+		return
+	}
+}
+
+// importExpressions submits the lines of an upload and records their outcome
+// in the job. An upload that cannot be read to the end fails the job but keeps
+// the expressions accepted so far. It returns database errors, which fail the
+// job too: its final status is stored even if the client has left.
+func (o *Orchestrator) importExpressions(ctx context.Context, job *database.ImportJob, next importReader) (err error) {
+	defer func() {
+		if err != nil {
+			job.Status, job.Error = "failed", err.Error()
+		} else if job.Status == "running" {
+			job.Status = "completed"
+		}
+		job.FinishedAt = time.Now()
+		if updateErr := o.Database.UpdateImportJob(context.WithoutCancel(ctx), job); err == nil {
+			err = updateErr
+		}
+	}()
+	var lines []database.ImportLine
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		err := o.Database.AddImportLines(ctx, job.ID, lines)
+		lines = lines[:0]
+		return err
+	}
+	for {
+		item, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			job.Status, job.Error = "failed", err.Error()
+			break
+		}
+		if job.Total == maxImportLines {
+			job.Status, job.Error = "failed", fmt.Sprintf("a file may contain at most %d expressions", maxImportLines)
+			break
+		}
+		job.Total++
+		line := database.ImportLine{Line: item.line}
+		err = item.err
+		if err == nil {
+			line.ExpressionID, err = o.importExpression(ctx, job.UserID, item.in)
+		}
+		var reqErr *requestError
+		switch {
+		case err == nil:
+			job.Accepted++
+		case errors.As(err, &reqErr):
+			line.Error = reqErr.msg
+			job.Rejected++
+		default:
+			return err
+		}
+		if lines = append(lines, line); len(lines) == importChunk {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// importExpression stores and starts a valid expression of an upload. Invalid
+// expressions are reported with a *requestError and not stored.
+func (o *Orchestrator) importExpression(ctx context.Context, userID int, in CalculateRequest) (int, error) {
+	if err := o.validateRequest(ctx, userID, &in); err != nil {
+		return 0, err
+	}
+	ast, err := calculation.ParseASTWithVariables(in.Expression, in.Variables)
+	if err != nil {
+		return 0, &requestError{err.Error()}
+	}
+	dbExpr, err := o.Database.CreateExpression(ctx, userID, in.Expression)
+	if err != nil {
+		return 0, err
+	}
+	o.startExpression(newExpression(dbExpr.ID, userID, in, ast))
+	return dbExpr.ID, nil
+}
+
+// ImportJobHandler serves GET /api/v1/imports/{id}: the summary of an import
+// job and the outcome of each line, only the rejected ones with ?rejected=true.
+func (o *Orchestrator) ImportJobHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method")
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/imports/"), ":"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid import job ID")
+		return
+	}
+	job, err := o.Database.GetImportJob(r.Context(), id, userID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "Import job not found")
+			return
+		}
+		storageError(w, err, "Failed to get import job")
+		return
+	}
+	lines, err := o.Database.GetImportLines(r.Context(), id, r.URL.Query().Get("rejected") == "true")
+	if err != nil {
+		storageError(w, err, "Failed to get import job")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"job": job, "lines": lines})
+}
@@ -0,0 +1,195 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var errAgentQuarantined = errors.New("agent is quarantined")
+
+// leasableBy reports whether agentID may lease the task. A task that needs
+// verification is only handed to identified agents, each of them at most once.
+func (t *Task) leasableBy(agentID string) bool {
+	if t.Replicas <= 1 {
+		return true
+	}
+	if agentID == "" {
+		return false
+	}
+	_, leased := t.leases[agentID]
+	_, voted := t.votes[agentID]
+	return !leased && !voted
+}
+
+// assignments is the number of agents currently working on or done with the task.
+func (t *Task) assignments() int {
+	return len(t.leases) + len(t.votes)
+}
+
+// takeTasks leases up to limit tasks whose operation is in ops for
+// Config.TaskLease milliseconds. A task stays queued until it is leased by
+// Replicas distinct agents. Leases taken by a registered agent are attributed
+// to it. It must be called with o.mu held.
+func (o *Orchestrator) takeTasks(agentID string, ops []string, limit int) []*Task {
+	if _, ok := o.agents[agentID]; !ok {
+		agentID = ""
+	}
+	leaseUntil := time.Now().Add(time.Duration(o.Config.TaskLease) * time.Millisecond)
+	var tasks, again []*Task
+	for len(tasks) < limit {
+		task := o.TaskQueue.Pop(func(t *Task) bool {
+			return supports(ops, t.Operation) && t.leasableBy(agentID)
+		})
+		if task == nil {
+			break
+		}
+		if task.leases == nil {
+			task.leases = make(map[string]time.Time)
+		}
+		task.leases[agentID] = leaseUntil
+		o.leases[task.ID] = task
+		tasks = append(tasks, task)
+		if task.assignments() < task.Replicas {
+			again = append(again, task)
+		} else {
+			task.queued = false
+		}
+	}
+	for _, task := range again {
+		o.TaskQueue.Requeue(task)
+	}
+	return tasks
+}
+
+// requeue puts an unfinished task back into the queue ahead of newer tasks
+// unless it is still queued. It must be called with o.mu held.
+func (o *Orchestrator) requeue(task *Task) {
+	if _, ok := o.taskStore[task.ID]; !ok || task.queued {
+		return
+	}
+	task.queued = true
+	o.TaskQueue.Requeue(task)
+	o.notifyTaskReady()
+}
+
+// releaseLease drops the lease agentID holds on the task and makes the task
+// available again. It must be called with o.mu held.
+func (o *Orchestrator) releaseLease(task *Task, agentID string) {
+	delete(task.leases, agentID)
+	if len(task.leases) == 0 {
+		delete(o.leases, task.ID)
+	}
+	o.requeue(task)
+}
+
+// releaseExpiredLeases returns tasks whose lease has run out to the queue so
+// another worker can pick them up. It must be called with o.mu held.
+func (o *Orchestrator) releaseExpiredLeases(now time.Time) {
+	expired := 0
+	for _, task := range o.leases {
+		for agentID, until := range task.leases {
+			if now.After(until) {
+				o.releaseLease(task, agentID)
+				expired++
+			}
+		}
+	}
+	if expired > 0 {
+		log.Printf("Re-queueing %d tasks with expired leases", expired)
+	}
+}
+
+func (o *Orchestrator) expireLeases() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		o.mu.Lock()
+		o.expireAgents(now)
+		o.releaseExpiredLeases(now)
+		o.markStuckTasks(now)
+		o.mu.Unlock()
+		o.flushWrites()
+	}
+}
+
+// leaseTasks leases up to limit tasks, waiting up to wait for at least one to
+// become available. Only tasks with an operation in ops are handed out; nil
+// ops fall back to the operations the agent registered with. It returns no
+// tasks on timeout or when ctx is done.
+func (o *Orchestrator) leaseTasks(ctx context.Context, agentID, secret string, ops []string, limit int, wait time.Duration) ([]*Task, error) {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	defer o.flushWrites()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.authenticate(agentID, secret); err != nil {
+		return nil, err
+	}
+	if _, ok := o.quarantined[agentID]; ok {
+		return nil, errAgentQuarantined
+	}
+	if _, ok := o.agents[agentID]; !ok {
+		o.anonymousPoll = time.Now()
+	}
+	ops = o.operationsOf(agentID, ops)
+	tasks := o.takeTasks(agentID, ops, limit)
+	for len(tasks) == 0 {
+		if timeout == nil {
+			return nil, nil
+		}
+		ready := o.taskReady
+		o.mu.Unlock()
+		select {
+		case <-ready:
+		case <-timeout:
+			o.mu.Lock()
+			return nil, nil
+		case <-ctx.Done():
+			o.mu.Lock()
+			return nil, nil
+		}
+		o.mu.Lock()
+		if err := o.authenticate(agentID, secret); err != nil {
+			return nil, err
+		}
+		if _, ok := o.quarantined[agentID]; ok {
+			return nil, errAgentQuarantined
+		}
+		tasks = o.takeTasks(agentID, ops, limit)
+	}
+	for _, task := range tasks {
+		if expr, exists := o.exprStore[task.ExprID]; exists {
+			stuck := expr.Status == "stuck"
+			expr.Status = "completed"
+			if stuck {
+				o.saveExpression(expr)
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// submitResults applies a batch of results reported by agentID and returns a
+// status per result.
+func (o *Orchestrator) submitResults(agentID, secret string, results []TaskResult) ([]string, error) {
+	statuses := make([]string, len(results))
+	defer o.flushWrites()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.authenticate(agentID, secret); err != nil {
+		return nil, err
+	}
+	for i, res := range results {
+		statuses[i] = "result accepted"
+		if err := o.submitResult(agentID, res); err != nil {
+			statuses[i] = err.Error()
+		}
+	}
+	return statuses, nil
+}
@@ -0,0 +1,66 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// memoKey identifies the computation of a single task. The operands of the
+// commutative + and * are ordered so 2*3 and 3*2 share an entry.
+type memoKey struct {
+	Operation  string
+	Arg1, Arg2 float64
+	Mode       string
+}
+
+func taskMemoKey(op string, arg1, arg2 float64) memoKey {
+	if (op == "+" || op == "*") && arg2 < arg1 {
+		arg1, arg2 = arg2, arg1
+	}
+	return memoKey{Operation: op, Arg1: arg1, Arg2: arg2, Mode: evalMode}
+}
+
+// memoize remembers the result of a task for later tasks with the same
+// operation and operands. It must be called with o.mu held.
+func (o *Orchestrator) memoize(task *Task, result float64) {
+	key := taskMemoKey(task.Operation, task.Arg1, task.Arg2)
+	o.memo.put(key, cachedResult{Result: result, Replicas: task.Replicas}, time.Now())
+}
+
+// memoized returns the remembered result of an operation if it was verified
+// by at least replicas agents. It must be called with o.mu held.
+func (o *Orchestrator) memoized(op string, arg1, arg2 float64, replicas int) (float64, bool) {
+	cached, ok := o.memo.get(taskMemoKey(op, arg1, arg2), time.Now())
+	if !ok || cached.Replicas < replicas {
+		return 0, false
+	}
+	return cached.Result, true
+}
+
+// cacheStats describes the use of a cache.
+type cacheStats struct {
+	Size      int   `json:"size"`
+	Entries   int   `json:"entries"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+func (c *lruCache[K, V]) stats() cacheStats {
+	return cacheStats{Size: c.size, Entries: c.len(), Hits: c.hits, Misses: c.misses, Evictions: c.evictions}
+}
+
+// CacheHandler serves GET /internal/cache: the use of the expression result
+// cache and of the task memo table.
+func (o *Orchestrator) CacheHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a GET Method")
+		return
+	}
+	o.mu.Lock()
+	resp := map[string]cacheStats{"results": o.results.stats(), "tasks": o.memo.stats()}
+	o.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
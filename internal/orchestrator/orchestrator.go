@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -24,6 +25,29 @@ type Config struct {
 	TimeSubtraction     int
 	TimeMultiplications int
 	TimeDivisions       int
+	TaskLease           int
+	Transport           string
+	GRPCAddr            string
+	HeartbeatInterval   int
+	AgentTimeout        int
+	AgentTokens         []string
+	OperatorTokens      []string
+	VerifyReplicas      int
+	Scheduler           string
+	WebhookSecret       string
+	WebhookAllowPrivate bool
+	WebhookMaxAttempts  int
+	WebhookBackoff      int
+	IdempotencyTTL      int
+	IdempotencyLease    int
+	ResultCacheSize     int
+	ResultCacheTTL      int
+	TaskMemoSize        int
+	RetentionMaxAge     int
+	RetentionMaxCount   int
+	RetentionInterval   int
+	DatabaseURL         string
+	DatabaseOptions     database.Options
 }
 
 func ConfigFromEnv() *Config {
@@ -47,12 +71,134 @@ func ConfigFromEnv() *Config {
 	if td == 0 {
 		td = 10
 	}
+	lease, _ := strconv.Atoi(os.Getenv("TASK_LEASE_MS"))
+	if lease == 0 {
+		lease = 30000
+	}
+	transport := os.Getenv("TRANSPORT")
+	if transport == "" {
+		transport = "http"
+	}
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "5000"
+	}
+	heartbeat, _ := strconv.Atoi(os.Getenv("HEARTBEAT_INTERVAL_MS"))
+	if heartbeat == 0 {
+		heartbeat = 5000
+	}
+	agentTimeout, _ := strconv.Atoi(os.Getenv("AGENT_TIMEOUT_MS"))
+	if agentTimeout == 0 {
+		agentTimeout = 3 * heartbeat
+	}
+	var agentTokens []string
+	for _, token := range strings.Split(os.Getenv("AGENT_TOKENS"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			agentTokens = append(agentTokens, token)
+		}
+	}
+	var operatorTokens []string
+	for _, token := range strings.Split(os.Getenv("OPERATOR_TOKENS"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			operatorTokens = append(operatorTokens, token)
+		}
+	}
+	replicas, _ := strconv.Atoi(os.Getenv("VERIFY_REPLICAS"))
+	if replicas < 1 || replicas > maxVerifyReplicas {
+		replicas = 1
+	}
+	scheduler := os.Getenv("SCHEDULER")
+	if scheduler == "" {
+		scheduler = "fair"
+	}
+	webhookAttempts, _ := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS"))
+	if webhookAttempts < 1 {
+		webhookAttempts = 8
+	}
+	webhookBackoff, _ := strconv.Atoi(os.Getenv("WEBHOOK_BACKOFF_MS"))
+	if webhookBackoff < 1 {
+		webhookBackoff = 1000
+	}
+	idempotencyTTL, _ := strconv.Atoi(os.Getenv("IDEMPOTENCY_TTL_MS"))
+	if idempotencyTTL < 1 {
+		idempotencyTTL = 24 * 60 * 60 * 1000
+	}
+	idempotencyLease, _ := strconv.Atoi(os.Getenv("IDEMPOTENCY_LEASE_MS"))
+	if idempotencyLease < 1 {
+		idempotencyLease = 60 * 1000
+	}
+	// An explicit RESULT_CACHE_SIZE=0 disables the result cache.
+	cacheSize := 1000
+	if v, ok := os.LookupEnv("RESULT_CACHE_SIZE"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cacheSize = n
+		}
+	}
+	cacheTTL, _ := strconv.Atoi(os.Getenv("RESULT_CACHE_TTL_MS"))
+	if cacheTTL < 1 {
+		cacheTTL = 10 * 60 * 1000
+	}
+	memoSize := 10000
+	if v, ok := os.LookupEnv("TASK_MEMO_SIZE"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			memoSize = n
+		}
+	}
+	retentionAge, _ := strconv.Atoi(os.Getenv("RETENTION_MAX_AGE_MS"))
+	retentionCount, _ := strconv.Atoi(os.Getenv("RETENTION_MAX_COUNT"))
+	maxOpenConns, _ := strconv.Atoi(os.Getenv("DB_MAX_OPEN_CONNS"))
+	if maxOpenConns < 1 {
+		maxOpenConns = 10
+	}
+	maxIdleConns, _ := strconv.Atoi(os.Getenv("DB_MAX_IDLE_CONNS"))
+	if maxIdleConns < 1 || maxIdleConns > maxOpenConns {
+		maxIdleConns = maxOpenConns
+	}
+	connLifetime, _ := strconv.Atoi(os.Getenv("DB_CONN_MAX_LIFETIME_MS"))
+	queryTimeout := 5000
+	if v, ok := os.LookupEnv("DB_QUERY_TIMEOUT_MS"); ok {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			queryTimeout = n
+		}
+	}
+	retentionInterval, _ := strconv.Atoi(os.Getenv("RETENTION_INTERVAL_MS"))
+	if retentionInterval < 1 {
+		retentionInterval = 60 * 60 * 1000
+	}
 	return &Config{
 		Addr:                port,
 		TimeAddition:        ta,
 		TimeSubtraction:     ts,
 		TimeMultiplications: tm,
 		TimeDivisions:       td,
+		TaskLease:           lease,
+		Transport:           transport,
+		GRPCAddr:            grpcPort,
+		HeartbeatInterval:   heartbeat,
+		AgentTimeout:        agentTimeout,
+		AgentTokens:         agentTokens,
+		OperatorTokens:      operatorTokens,
+		VerifyReplicas:      replicas,
+		Scheduler:           scheduler,
+		WebhookSecret:       os.Getenv("WEBHOOK_SECRET"),
+		WebhookAllowPrivate: os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true",
+		WebhookMaxAttempts:  webhookAttempts,
+		WebhookBackoff:      webhookBackoff,
+		IdempotencyTTL:      idempotencyTTL,
+		IdempotencyLease:    idempotencyLease,
+		ResultCacheSize:     cacheSize,
+		ResultCacheTTL:      cacheTTL,
+		TaskMemoSize:        memoSize,
+		RetentionMaxAge:     retentionAge,
+		RetentionMaxCount:   retentionCount,
+		RetentionInterval:   retentionInterval,
+		DatabaseURL:         os.Getenv("DATABASE_URL"),
+		DatabaseOptions: database.Options{
+			MaxOpenConns:    maxOpenConns,
+			MaxIdleConns:    maxIdleConns,
+			ConnMaxLifetime: time.Duration(connLifetime) * time.Millisecond,
+			QueryTimeout:    time.Duration(queryTimeout) * time.Millisecond,
+		},
 	}
 }
 
@@ -60,25 +206,83 @@ type Orchestrator struct {
 	Config      *Config
 	exprStore   map[string]*Expression
 	taskStore   map[string]*Task
-	TaskQueue   []*Task
+	TaskQueue   Scheduler
+	leases      map[string]*Task
+	agents      map[string]*AgentInfo
+	quarantined map[string]quarantine
 	mu          sync.Mutex
 	taskCounter int64
-	Database    *database.DataBase
+	taskReady   chan struct{}
+	events      *eventHub
+	webhooks    chan struct{}
+	results     *lruCache[string, cachedResult]
+	memo        *lruCache[memoKey, cachedResult]
+	inflight    map[string]*Expression
+	// stuck holds the expressions markStuckTasks set to "stuck".
+	stuck map[string]*Expression
+	// webhookClient sends webhook deliveries.
+	webhookClient *http.Client
+	// anonymousPoll is when an agent that did not register last asked for
+	// tasks.
+	anonymousPoll time.Time
+	// pendingRows and pendingDeliveries are written with o.mu held and
+	// stored by flushWrites once it is released.
+	pendingRows       []*database.Expression
+	pendingDeliveries []*database.Delivery
+	// writeMu keeps flushWrites storing writes in the order they were made.
+	writeMu  sync.Mutex
+	Database database.Storage
 }
 
+const (
+	// maxTaskWait caps the wait parameter of GET /internal/task so an agent
+	// cannot hold a connection open indefinitely.
+	maxTaskWait = 60 * time.Second
+	// maxTaskBatch caps the number of tasks handed out by a single request.
+	maxTaskBatch = 100
+)
+
+// NewOrchestrator configures an orchestrator from the environment and opens
+// the storage at DATABASE_URL.
 func NewOrchestrator() *Orchestrator {
-	database, err := database.CreateTable()
+	config := ConfigFromEnv()
+	store, err := database.Open(config.DatabaseURL, config.DatabaseOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
+	o, err := New(config, store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return o
+}
+
+// New returns an orchestrator keeping its users and expressions in store.
+func New(config *Config, store database.Storage) (*Orchestrator, error) {
+	scheduler, err := NewScheduler(config.Scheduler)
+	if err != nil {
+		return nil, err
+	}
 
-	return &Orchestrator{
-		Config:    ConfigFromEnv(),
-		exprStore: make(map[string]*Expression),
-		taskStore: make(map[string]*Task),
-		TaskQueue: make([]*Task, 0),
-		Database:  database,
+	o := &Orchestrator{
+		Config:      config,
+		exprStore:   make(map[string]*Expression),
+		taskStore:   make(map[string]*Task),
+		TaskQueue:   scheduler,
+		leases:      make(map[string]*Task),
+		agents:      make(map[string]*AgentInfo),
+		quarantined: make(map[string]quarantine),
+		taskReady:   make(chan struct{}),
+		events:      newEventHub(),
+		webhooks:    make(chan struct{}, 1),
+		results:     newLRUCache[string, cachedResult](config.ResultCacheSize, time.Duration(config.ResultCacheTTL)*time.Millisecond),
+		memo:        newLRUCache[memoKey, cachedResult](config.TaskMemoSize, 0),
+		inflight:    make(map[string]*Expression),
+		stuck:       make(map[string]*Expression),
+		Database:    store,
 	}
+	o.webhookClient = o.newWebhookClient()
+	return o, nil
 }
 
 type Expression struct {
@@ -88,6 +292,26 @@ type Expression struct {
 	Status string            `json:"status"`
 	Result *float64          `json:"result"`
 	AST    *calculation.Node `json:"-"`
+	// Error is the reason the expression failed.
+	Error string `json:"error,omitempty"`
+	// Replicas is the number of distinct agents each task of the expression
+	// is sent to; values above 1 enable result verification.
+	Replicas int `json:"-"`
+	// Priority orders the expression's tasks among the other tasks of the
+	// same user; higher values are scheduled first.
+	Priority int `json:"-"`
+	// CallbackURL receives a webhook once the expression is done.
+	CallbackURL string `json:"-"`
+	// CreatedAt is reported when the expression is read from the database
+	// and its creation time is known.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+
+	// key addresses the expression in the result cache. An expression
+	// sharing the tasks of an identical one has it as leader; the leader
+	// finishes its followers when it is done.
+	key       string
+	leader    *Expression
+	followers []*Expression
 }
 
 type Task struct {
@@ -99,6 +323,15 @@ type Task struct {
 	Operation     string            `json:"operation"`
 	OperationTime int               `json:"operation_time"`
 	Node          *calculation.Node `json:"-"`
+	Replicas      int               `json:"-"`
+	Priority      int               `json:"-"`
+	Weight        int               `json:"-"`
+	quorum        int
+	queued        bool
+	stuck         bool
+	seq           int64
+	leases        map[string]time.Time
+	votes         map[string]TaskResult
 }
 
 var req struct {
@@ -107,7 +340,7 @@ var req struct {
 
 func (o *Orchestrator) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
@@ -117,30 +350,30 @@ func (o *Orchestrator) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
 	if req.Login == "" || req.Password == "" {
-		http.Error(w, `{"error":"Login and password are required"}`, http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Login and password are required")
 		return
 	}
 
 	hashedPassword, err := auth.HashPass(req.Password)
 	if err != nil {
 		log.Printf("Failed to hash password: %v", err)
-		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
-	userID, err := o.Database.InsertUser(req.Login, hashedPassword)
+	userID, err := o.Database.InsertUser(r.Context(), req.Login, hashedPassword)
 	if err != nil {
-		if errors.Is(err, errors.New("already exists")) {
-			http.Error(w, `{"error":"User already exists"}`, http.StatusConflict)
+		if errors.Is(err, database.ErrDuplicateLogin) {
+			writeError(w, http.StatusConflict, "User already exists")
 			return
 		}
 		log.Printf("Failed to create user: %v", err)
-		http.Error(w, `{"error":"User already exists"}`, http.StatusConflict)
+		storageError(w, err, "Internal server error")
 		return
 	}
 
@@ -154,7 +387,7 @@ func (o *Orchestrator) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 func (o *Orchestrator) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, `{"error":"Method not allowed"}`, http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 		return
 	}
 
@@ -164,29 +397,29 @@ func (o *Orchestrator) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	user, err := o.Database.SelectUser(req.Login)
+	user, err := o.Database.SelectUser(r.Context(), req.Login)
 	if err != nil {
-		if errors.Is(err, errors.New("not found")) {
-			http.Error(w, `{"error":"Invalid credentials"}`, http.StatusUnauthorized)
+		if errors.Is(err, database.ErrNotFound) {
+			writeError(w, http.StatusUnauthorized, "Invalid credentials")
 			return
 		}
 		log.Printf("Failed to get user: %v", err)
-		http.Error(w, `{"error":"Invalid credentials"}`, http.StatusUnauthorized)
+		storageError(w, err, "Internal server error")
 		return
 	}
 
 	if auth.CheckCorPass(req.Password, user.Password) {
-		http.Error(w, `{"error":"Invalid credentials"}`, http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, "Invalid credentials")
 		return
 	}
 	token, err := auth.GenJWT(int(user.ID))
 	if err != nil {
 		log.Printf("Failed to generate token: %v", err)
-		http.Error(w, `{"error":"Internal server error"}`, http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
@@ -202,26 +435,50 @@ func (o *Orchestrator) LoginHandler(w http.ResponseWriter, r *http.Request) {
 
 func (o *Orchestrator) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/api/v1/login" || r.URL.Path == "/api/v1/register" || r.URL.Path == "/internal/task" {
+		if r.URL.Path == "/api/v1/login" || r.URL.Path == "/api/v1/register" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/internal/") && operatorRequest(r) {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !auth.CheckAgentToken(token, o.Config.OperatorTokens) {
+				log.Printf("Rejected operator request %s %s from %s: invalid operator token", r.Method, r.URL.Path, r.RemoteAddr)
+				writeError(w, http.StatusUnauthorized, "Invalid operator token")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/internal/") {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !auth.CheckAgentToken(token, o.Config.AgentTokens) {
+				log.Printf("Rejected agent request %s %s from %s: invalid agent token", r.Method, r.URL.Path, r.RemoteAddr)
+				writeError(w, http.StatusUnauthorized, "Invalid agent token")
+				return
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
 
 		authHeader := r.Header.Get("Authorization")
+		if token := r.URL.Query().Get("token"); authHeader == "" && token != "" && acceptsQueryToken(r.URL.Path) {
+			authHeader = "Bearer " + token
+		}
 		if authHeader == "" {
-			http.Error(w, `{"error":"Authorization header is required"}`, http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, "Authorization header is required")
 			return
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 		if tokenString == "" {
-			http.Error(w, `{"error":"Invalid authorization header format"}`, http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, "Invalid authorization header format")
 			return
 		}
 
 		userID, err := auth.ParseJWT(tokenString)
 		if err != nil {
-			http.Error(w, `{"error":"Invalid token"}`, http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, "Invalid token")
 			return
 		}
 		ctx := context.WithValue(r.Context(), req, userID)
@@ -232,245 +489,745 @@ func (o *Orchestrator) AuthMiddleware(next http.Handler) http.Handler {
 func (o *Orchestrator) CalculateHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(req).(int)
 	if !ok {
-		http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
 	if r.Method != http.MethodPost {
-		http.Error(w, `{"error":"Wrong Method: Need a POST Method"}`, http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a POST Method")
 		return
 	}
-	var req struct {
-		Expression string `json:"expression"`
-	}
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.Expression == "" {
-		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+	var body CalculateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "Invalid Body")
 		return
 	}
-
-	dbExpr, err := o.Database.CreateExpression(userID, req.Expression)
+	id, cache, err := o.submitExpression(r.Context(), userID, body, nil)
 	if err != nil {
-		http.Error(w, `{"error":"Failed to create expression"}`, http.StatusInternalServerError)
+		var reqErr *requestError
+		if errors.As(err, &reqErr) {
+			writeError(w, http.StatusUnprocessableEntity, reqErr.msg)
+			return
+		}
+		storageError(w, err, "Failed to create expression")
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "cache": cache})
+}
 
-	expr := &Expression{
-		ID:     strconv.Itoa(dbExpr.ID),
-		Expr:   req.Expression,
-		Status: "pending",
-		UserID: strconv.Itoa(userID),
+// CalculateRequest is the body of POST /api/v1/calculate.
+type CalculateRequest struct {
+	Expression string `json:"expression"`
+	Replicas   int    `json:"replicas"`
+	Priority   int    `json:"priority"`
+	// CallbackURL overrides the default webhook of the user.
+	CallbackURL string `json:"callback_url"`
+	// Variables are the values of the names used in the expression.
+	Variables map[string]float64 `json:"variables"`
+}
+
+// requestError is returned by submitExpression when the request is invalid.
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+// submitExpression stores a new expression of the user and starts it. It
+// returns the expression ID and the cache outcome. created, if not nil, is
+// called with the new expression ID right before the expression is started.
+func (o *Orchestrator) submitExpression(ctx context.Context, userID int, in CalculateRequest, created func(id string)) (string, string, error) {
+	if err := o.validateRequest(ctx, userID, &in); err != nil {
+		return "", "", err
+	}
+
+	dbExpr, err := o.Database.CreateExpression(ctx, userID, in.Expression)
+	if err != nil {
+		return "", "", err
 	}
-	ast, err := calculation.ParseAST(req.Expression)
+
+	ast, err := calculation.ParseASTWithVariables(in.Expression, in.Variables)
 
 	if err != nil {
-		o.Database.UpdateExpression(&database.Expression{
+		o.Database.UpdateExpression(ctx, &database.Expression{
 			ID:     dbExpr.ID,
+			UserID: userID,
 			Status: "error",
+			Error:  err.Error(),
 		})
 
-		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err.Error()), http.StatusUnprocessableEntity)
-		return
+		return "", "", &requestError{err.Error()}
+	}
+	expr := newExpression(dbExpr.ID, userID, in, ast)
+	if created != nil {
+		created(expr.ID)
+	}
+	return expr.ID, o.startExpression(expr), nil
+}
+
+// validateRequest checks the options of a request and fills in the defaults:
+// the configured number of replicas and the user's default webhook. The
+// priority is clamped to [-maxPriority, maxPriority].
+func (o *Orchestrator) validateRequest(ctx context.Context, userID int, in *CalculateRequest) error {
+	if in.Expression == "" {
+		return &requestError{"Invalid Body"}
+	}
+	if in.Replicas == 0 {
+		in.Replicas = o.Config.VerifyReplicas
+	}
+	if in.Replicas < 1 || in.Replicas > maxVerifyReplicas {
+		return &requestError{fmt.Sprintf("replicas must be between 1 and %d", maxVerifyReplicas)}
+	}
+	in.Priority = max(-maxPriority, min(in.Priority, maxPriority))
+	callbackURL, err := o.callbackURL(ctx, userID, in.CallbackURL)
+	if err != nil {
+		return err
+	}
+	in.CallbackURL = callbackURL
+	return nil
+}
+
+func newExpression(id, userID int, in CalculateRequest, ast *calculation.Node) *Expression {
+	return &Expression{
+		ID:          strconv.Itoa(id),
+		Expr:        in.Expression,
+		Status:      "pending",
+		UserID:      strconv.Itoa(userID),
+		AST:         ast,
+		Replicas:    in.Replicas,
+		Priority:    in.Priority,
+		CallbackURL: in.CallbackURL,
 	}
-	expr.AST = ast
-	o.exprStore[expr.ID] = expr
-	o.ScheduleTasks(expr)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"id": expr.ID})
 }
 
 func (o *Orchestrator) ExpressionsHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(req).(int)
 	if !ok {
-		http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
 	if r.Method != http.MethodGet {
-		http.Error(w, `{"error":"Wrong Method: Need a GET Method"}`, http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a GET Method")
 		return
 	}
 
-	dbExprs, err := o.Database.GetExpressions(userID)
+	query, err := expressionQuery(r.URL.Query())
 	if err != nil {
-		http.Error(w, `{"error":"Failed to get expressions"}`, http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := o.Database.ListExpressions(r.Context(), userID, query)
+	if err != nil {
+		if errors.Is(err, database.ErrInvalidCursor) {
+			writeError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		storageError(w, err, "Failed to get expressions")
 		return
 	}
 
-	exprs := make([]*Expression, len(dbExprs))
-	for i, dbExpr := range dbExprs {
+	exprs := make([]*Expression, len(page.Expressions))
+	for i, dbExpr := range page.Expressions {
 		exprs[i] = &Expression{
-			ID:     strconv.Itoa(dbExpr.ID),
-			Expr:   dbExpr.Expression,
-			Status: dbExpr.Status,
-			Result: dbExpr.Result,
+			ID:        strconv.Itoa(dbExpr.ID),
+			Expr:      dbExpr.Expression,
+			Status:    dbExpr.Status,
+			Result:    dbExpr.Result,
+			Error:     dbExpr.Error,
+			CreatedAt: createdAt(dbExpr.CreatedAt),
 		}
 	}
+	resp := map[string]interface{}{"expressions": exprs}
+	if page.NextCursor != "" {
+		resp["next_cursor"] = page.NextCursor
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"expressions": exprs})
+	json.NewEncoder(w).Encode(resp)
+}
+
+const (
+	// defaultPageSize and maxPageSize bound the limit parameter of
+	// GET /api/v1/expressions.
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// expressionQuery reads the pagination, filter and sort parameters of
+// GET /api/v1/expressions.
+func expressionQuery(params url.Values) (database.ExpressionQuery, error) {
+	filter, err := expressionFilter(params)
+	q := database.ExpressionQuery{
+		ExpressionFilter: filter,
+		Limit:            defaultPageSize,
+		Cursor:           params.Get("cursor"),
+		Sort:             params.Get("sort"),
+	}
+	if err != nil {
+		return q, err
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = limit
+	}
+	if q.Sort != "" && !database.ValidExpressionSort(q.Sort) {
+		return q, errors.New("sort must be one of id, created_at, status, expression")
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+	return q, nil
+}
+
+// expressionFilter reads the status, from, to and q filter parameters.
+func expressionFilter(params url.Values) (database.ExpressionFilter, error) {
+	f := database.ExpressionFilter{Search: params.Get("q")}
+	for _, status := range strings.Split(params.Get("status"), ",") {
+		if status = strings.TrimSpace(status); status != "" {
+			f.Statuses = append(f.Statuses, status)
+		}
+	}
+	for name, bound := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if v := params.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, fmt.Errorf("%s must be an RFC 3339 time", name)
+			}
+			*bound = t
+		}
+	}
+	return f, nil
 }
 
 func (o *Orchestrator) ExpressionByIDHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(req).(int)
 	if !ok {
-		http.Error(w, `{"error":"Unauthorized"}`, http.StatusUnauthorized)
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
 	if r.Method != http.MethodGet {
-		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method")
 		return
 	}
-	id := string(r.URL.Path[len("/api/v1/expressions/"):][1:])
-	idInt, err := strconv.Atoi(id)
+	idInt, err := expressionID(r.URL.Path, "")
 	if err != nil {
-		http.Error(w, `{"error":"Invalid expression ID"}`, http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "Invalid expression ID")
 		return
 	}
-	dbExpr, err := o.Database.GetExpressionByID(idInt, userID)
+	dbExpr, err := o.Database.GetExpressionByID(r.Context(), idInt, userID)
 	if err != nil {
-		if errors.Is(err, errors.New("not found")) {
-			http.Error(w, `{"error":"Expression not found"}`, http.StatusNotFound)
+		if errors.Is(err, database.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "Expression not found")
 			return
 		}
-		http.Error(w, `{"error":"Failed to get expression"}`, http.StatusInternalServerError)
+		storageError(w, err, "Failed to get expression")
 		return
 	}
 
 	expr := &Expression{
-		ID:     id,
-		Expr:   dbExpr.Expression,
-		Status: dbExpr.Status,
-		Result: dbExpr.Result,
+		ID:        strconv.Itoa(idInt),
+		Expr:      dbExpr.Expression,
+		Status:    dbExpr.Status,
+		Result:    dbExpr.Result,
+		Error:     dbExpr.Error,
+		CreatedAt: createdAt(dbExpr.CreatedAt),
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"expression": expr})
 }
 
+// createdAt returns the creation time of a stored expression in UTC, or nil
+// if it is unknown.
+func createdAt(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
 func (o *Orchestrator) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method")
 		return
 	}
-	o.mu.Lock()
-	defer o.mu.Unlock()
-	if len(o.TaskQueue) == 0 {
-		http.Error(w, `{"error":"No task available"}`, http.StatusNotFound)
+	wait, err := parseWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid wait parameter")
 		return
 	}
-	task := o.TaskQueue[0]
-	o.TaskQueue = o.TaskQueue[1:]
-	if expr, exists := o.exprStore[task.ExprID]; exists {
-		expr.Status = "completed"
+	batch := r.URL.Query().Has("max")
+	limit := 1
+	if batch {
+		limit, err = strconv.Atoi(r.URL.Query().Get("max"))
+		if err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, "Invalid max parameter")
+			return
+		}
+		if limit > maxTaskBatch {
+			limit = maxTaskBatch
+		}
+	}
+	ops := parseOperations(r.URL.Query().Get("ops"))
+	tasks, err := o.leaseTasks(r.Context(), r.Header.Get("X-Agent-ID"), r.Header.Get("X-Agent-Secret"), ops, limit, wait)
+	if errors.Is(err, errAgentSecret) {
+		writeError(w, http.StatusForbidden, "Invalid agent secret")
+		return
+	}
+	if errors.Is(err, errAgentAnonymous) {
+		writeError(w, http.StatusForbidden, "Agent must register")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusForbidden, "Agent is quarantined")
+		return
+	}
+	if len(tasks) == 0 {
+		writeError(w, http.StatusNotFound, "No task available")
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{"task": task})
+	if batch {
+		json.NewEncoder(w).Encode(map[string]interface{}{"tasks": tasks})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"task": tasks[0]})
+}
+
+// parseWait reads the long-polling timeout of GET /internal/task. The value is
+// either a number of seconds or a Go duration string and is capped at maxTaskWait.
+func parseWait(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(s)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(s)
+		if convErr != nil {
+			return 0, err
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, errors.New("negative wait")
+	}
+	if wait > maxTaskWait {
+		wait = maxTaskWait
+	}
+	return wait, nil
 }
 
+type TaskResult struct {
+	ID     string  `json:"id"`
+	Result float64 `json:"result"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// PostTaskHandler accepts either a single result ({"id", "result"}) or a batch
+// ({"results": [...]}). A batch is answered with a per-result status.
 func (o *Orchestrator) PostTaskHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, `{"error":"Wrong Method"}`, http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method")
 		return
 	}
 	var req struct {
-		ID     string  `json:"id"`
-		Result float64 `json:"result"`
+		TaskResult
+		Results []TaskResult `json:"results"`
 	}
 	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.ID == "" {
-		http.Error(w, `{"error":"Invalid Body"}`, http.StatusUnprocessableEntity)
+	if err != nil || (req.ID == "" && len(req.Results) == 0) {
+		writeError(w, http.StatusUnprocessableEntity, "Invalid Body")
 		return
 	}
-	o.mu.Lock()
-	task, ok := o.taskStore[req.ID]
-	if !ok {
+	agentID, secret := r.Header.Get("X-Agent-ID"), r.Header.Get("X-Agent-Secret")
+	if req.Results == nil {
+		o.mu.Lock()
+		err := o.authenticate(agentID, secret)
+		if err == nil {
+			err = o.submitResult(agentID, req.TaskResult)
+		}
 		o.mu.Unlock()
-		http.Error(w, `{"error":"Task not found"}`, http.StatusNotFound)
-		return
-	}
-	task.Node.IsLeaf = true
-	task.Node.Value = req.Result
-	if expr, exists := o.exprStore[task.ExprID]; exists {
-		o.ScheduleTasks(expr)
-		if expr.AST.IsLeaf {
-			expr.Status = "completed"
-			expr.Result = &expr.AST.Value
+		o.flushWrites()
+		if errors.Is(err, errTaskNotFound) {
+			writeError(w, http.StatusNotFound, "Task not found")
+			return
 		}
-		user_id, err := strconv.Atoi(expr.UserID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if errors.Is(err, errAgentSecret) || errors.Is(err, errAgentAnonymous) || errors.Is(err, errAgentQuarantined) || errors.Is(err, errTaskNotLeased) {
+			writeError(w, http.StatusForbidden, err.Error())
 			return
 		}
-		id, err := strconv.Atoi(expr.ID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("Failed to apply result of task %s: %v", req.ID, err)
+			writeError(w, http.StatusInternalServerError, "Internal server error")
 			return
 		}
-		o.Database.UpdateExpression(&database.Expression{
-			UserID:     user_id,
-			ID:         id,
-			Expression: expr.Expr,
-			Status:     expr.Status,
-			Result:     expr.Result,
-		})
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"result accepted"}`))
+		return
+	}
+
+	results, err := o.submitResults(agentID, secret, req.Results)
+	if errors.Is(err, errAgentAnonymous) {
+		writeError(w, http.StatusForbidden, "Agent must register")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusForbidden, "Invalid agent secret")
+		return
+	}
+	statuses := make([]map[string]string, len(req.Results))
+	for i, status := range results {
+		statuses[i] = map[string]string{"id": req.Results[i].ID, "status": status}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": statuses})
+}
+
+var errTaskNotFound = errors.New("task not found")
+
+var (
+	errExpressionNotFound = errors.New("expression not found")
+	errExpressionFinished = errors.New("expression already finished")
+)
+
+// submitResult handles the result of a task reported by agentID, which must
+// hold a lease on the task. Results of tasks that need verification are
+// collected until a quorum agrees. It must be called with o.mu held.
+func (o *Orchestrator) submitResult(agentID string, res TaskResult) error {
+	task, ok := o.taskStore[res.ID]
+	if !ok {
+		return errTaskNotFound
+	}
+	if _, ok := o.quarantined[agentID]; ok {
+		return errAgentQuarantined
+	}
+	agent, registered := o.agents[agentID]
+	if task.Replicas > 1 {
+		if err := o.vote(task, agentID, res); err != nil {
+			return err
+		}
+		if registered {
+			agent.CompletedTasks++
+		}
+		return nil
+	}
+	// Leases of agents that did not register are held anonymously.
+	holder := agentID
+	if !registered {
+		holder = ""
+	}
+	if _, leased := task.leases[holder]; !leased {
+		return errTaskNotLeased
+	}
+	if registered {
+		agent.CompletedTasks++
+	}
+	o.finishTask(task)
+	o.applyResult(task, res)
+	return nil
+}
+
+// finishTask forgets a task together with all of its leases and drops it from
+// the queue. It must be called with o.mu held.
+func (o *Orchestrator) finishTask(task *Task) {
+	if task.queued {
+		o.TaskQueue.Remove(task)
+		task.queued = false
+	}
+	delete(o.taskStore, task.ID)
+	delete(o.leases, task.ID)
+	task.leases = nil
+}
+
+// dropTasks forgets the remaining tasks of an expression that will not be
+// completed, so agents stop working on them. It must be called with o.mu
+// held.
+func (o *Orchestrator) dropTasks(exprID string) {
+	for _, task := range o.taskStore {
+		if task.ExprID == exprID {
+			o.finishTask(task)
+		}
+	}
+}
+
+// applyResult writes the result of a task into its expression and schedules
+// the tasks it unlocks. It must be called with o.mu held.
+func (o *Orchestrator) applyResult(task *Task, res TaskResult) {
+	expr, exists := o.exprStore[task.ExprID]
+	if !exists {
+		return
 	}
+	if res.Error != "" {
+		log.Printf("Task %s of expression %s failed: %s", task.ID, expr.ID, res.Error)
+		o.dropTasks(expr.ID)
+		expr.Status = "error"
+		expr.Error = res.Error
+		o.events.publish(Event{Type: "done", ExprID: expr.ID, TaskID: task.ID, Status: expr.Status, Error: res.Error})
+		o.notifyWebhook(expr, res.Error)
+		o.expressionDone(expr, res.Error)
+	} else {
+		task.Node.IsLeaf = true
+		task.Node.Value = res.Result
+		result := res.Result
+		o.memoize(task, result)
+		o.events.publish(Event{Type: "task_completed", ExprID: expr.ID, TaskID: task.ID, Operation: task.Operation, Result: &result})
+		if o.scheduleExpression(expr) {
+			return
+		}
+	}
+	o.saveExpression(expr)
+}
+
+// scheduleExpression schedules the tasks of an expression that became ready
+// and completes the expression once its root value is known. It reports
+// whether the expression was completed and saved. It must be called with o.mu
+// held.
+func (o *Orchestrator) scheduleExpression(expr *Expression) bool {
+	o.ScheduleTasks(expr)
+	if !expr.AST.IsLeaf {
+		return false
+	}
+	expr.Status = "completed"
+	expr.Result = &expr.AST.Value
+	o.finishExpression(expr, "")
+	o.expressionDone(expr, "")
+	return true
+}
+
+// cancelExpression stops an unfinished expression of the user: its tasks are
+// dropped from the queue, results still in flight are rejected and the status
+// becomes "cancelled".
+func (o *Orchestrator) cancelExpression(userID int, id string) error {
+	defer o.flushWrites()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	expr, ok := o.exprStore[id]
+	if !ok || expr.UserID != strconv.Itoa(userID) {
+		return errExpressionNotFound
+	}
+	if finished(expr.Status, expr.Result) {
+		return errExpressionFinished
+	}
+	o.dropTasks(id)
+	o.detachExpression(expr)
+	expr.Status = "cancelled"
+	delete(o.exprStore, id)
+	o.publishStatus(expr)
+	o.saveExpression(expr)
+	return nil
+}
+
+// saveExpression queues the status and result of an expression for
+// flushWrites. It must be called with o.mu held.
+func (o *Orchestrator) saveExpression(expr *Expression) {
+	row, err := expressionRow(expr)
+	if err != nil {
+		log.Printf("Failed to update expression %s: %v", expr.ID, err)
+		return
+	}
+	o.pendingRows = append(o.pendingRows, row)
+}
+
+// expressionRow copies the status and result of an expression as they are
+// kept in the database. It must be called with o.mu held.
+func expressionRow(expr *Expression) (*database.Expression, error) {
+	userID, err := strconv.Atoi(expr.UserID)
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(expr.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &database.Expression{
+		UserID:     userID,
+		ID:         id,
+		Expression: expr.Expr,
+		Status:     expr.Status,
+		Result:     expr.Result,
+		Error:      expr.Error,
+	}, nil
+}
+
+// flushWrites stores the expressions and webhook deliveries queued with o.mu
+// held. It must be called without o.mu, so a slow database does not hold up
+// agents and clients, and returns at once when nothing is queued. The writes
+// outlive the request that made them, so only the query timeout of the
+// storage applies. Expressions whose final state is written are dropped from
+// memory.
+func (o *Orchestrator) flushWrites() {
+	o.mu.Lock()
+	idle := len(o.pendingRows) == 0 && len(o.pendingDeliveries) == 0
+	o.mu.Unlock()
+	if idle {
+		return
+	}
+	o.writeMu.Lock()
+	defer o.writeMu.Unlock()
+	o.mu.Lock()
+	rows, deliveries := o.pendingRows, o.pendingDeliveries
+	o.pendingRows, o.pendingDeliveries = nil, nil
 	o.mu.Unlock()
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"result accepted"}`))
+
+	ctx := context.Background()
+	for _, row := range rows {
+		if err := o.Database.UpdateExpression(ctx, row); err != nil {
+			log.Printf("Failed to update expression %d: %v", row.ID, err)
+		}
+	}
+	// Finished expressions are forgotten once their final state is written,
+	// so a reader that does not find one in exprStore reads that state from
+	// the database.
+	o.mu.Lock()
+	for _, row := range rows {
+		id := strconv.Itoa(row.ID)
+		if expr, ok := o.exprStore[id]; ok && finished(row.Status, row.Result) && finished(expr.Status, expr.Result) {
+			delete(o.exprStore, id)
+		}
+	}
+	o.mu.Unlock()
+	stored := false
+	for _, dl := range deliveries {
+		if err := o.Database.CreateDelivery(ctx, dl); err != nil {
+			log.Printf("Failed to store webhook for expression %d: %v", dl.ExpressionID, err)
+			continue
+		}
+		stored = true
+	}
+	if stored {
+		select {
+		case o.webhooks <- struct{}{}:
+		default:
+		}
+	}
 }
 
+// operationTime returns the simulated duration of an operation in milliseconds.
+func (o *Orchestrator) operationTime(operator string) int {
+	switch operator {
+	case "+":
+		return o.Config.TimeAddition
+	case "-":
+		return o.Config.TimeSubtraction
+	case "*":
+		return o.Config.TimeMultiplications
+	case "/":
+		return o.Config.TimeDivisions
+	default:
+		return 100
+	}
+}
+
+// ScheduleTasks queues a task for every node whose operands are both known.
+// Each task is weighted with the operation times on the path from its node to
+// the root, i.e. the work that still has to run after it. Nodes whose
+// operation is in the memo table are resolved without a task, which may make
+// their parents ready in the same pass.
 func (o *Orchestrator) ScheduleTasks(expr *Expression) {
-	var traverse func(node *calculation.Node)
-	traverse = func(node *calculation.Node) {
+	scheduled := false
+	var traverse func(node *calculation.Node, above int)
+	traverse = func(node *calculation.Node, above int) {
 		if node == nil || node.IsLeaf {
 			return
 		}
-		traverse(node.Left)
-		traverse(node.Right)
-		if node.Left != nil && node.Right != nil && node.Left.IsLeaf && node.Right.IsLeaf {
-			if !node.TaskScheduled {
-				o.taskCounter++
-				taskID := fmt.Sprintf("%d", o.taskCounter)
-				var opTime int
-				switch node.Operator {
-				case "+":
-					opTime = o.Config.TimeAddition
-				case "-":
-					opTime = o.Config.TimeSubtraction
-				case "*":
-					opTime = o.Config.TimeMultiplications
-				case "/":
-					opTime = o.Config.TimeDivisions
-				default:
-					opTime = 100
-				}
-				task := &Task{
-					ID:            taskID,
-					ExprID:        expr.ID,
-					UserID:        expr.UserID,
-					Arg1:          node.Left.Value,
-					Arg2:          node.Right.Value,
-					Operation:     node.Operator,
-					OperationTime: opTime,
-					Node:          node,
-				}
-				node.TaskScheduled = true
-				o.taskStore[taskID] = task
-				o.TaskQueue = append(o.TaskQueue, task)
+		opTime := o.operationTime(node.Operator)
+		traverse(node.Left, above+opTime)
+		traverse(node.Right, above+opTime)
+		if node.Left != nil && node.Right != nil && node.Left.IsLeaf && node.Right.IsLeaf && !node.TaskScheduled {
+			replicas := max(expr.Replicas, 1)
+			if result, ok := o.memoized(node.Operator, node.Left.Value, node.Right.Value, replicas); ok {
+				node.IsLeaf = true
+				node.Value = result
+				o.events.publish(Event{Type: "task_completed", ExprID: expr.ID, Operation: node.Operator, Result: &result})
+				return
+			}
+			o.taskCounter++
+			taskID := fmt.Sprintf("%d", o.taskCounter)
+			task := &Task{
+				ID:            taskID,
+				ExprID:        expr.ID,
+				UserID:        expr.UserID,
+				Arg1:          node.Left.Value,
+				Arg2:          node.Right.Value,
+				Operation:     node.Operator,
+				OperationTime: opTime,
+				Node:          node,
+				Replicas:      replicas,
+				Priority:      expr.Priority,
+				Weight:        above + opTime,
+				quorum:        replicas/2 + 1,
+				queued:        true,
 			}
+			node.TaskScheduled = true
+			o.taskStore[taskID] = task
+			o.TaskQueue.Push(task)
+			o.events.publish(Event{Type: "task_scheduled", ExprID: expr.ID, TaskID: taskID, Operation: task.Operation})
+			scheduled = true
 		}
 	}
-	traverse(expr.AST)
+	traverse(expr.AST, 0)
+	if scheduled {
+		o.notifyTaskReady()
+	}
 }
 
-func (o *Orchestrator) RunServer() error {
+// notifyTaskReady wakes every GetTaskHandler blocked in a long poll.
+// It must be called with o.mu held.
+func (o *Orchestrator) notifyTaskReady() {
+	close(o.taskReady)
+	o.taskReady = make(chan struct{})
+}
+
+// Handler returns the HTTP API of the orchestrator wrapped in AuthMiddleware.
+func (o *Orchestrator) Handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/register", o.RegisterHandler)
 	mux.HandleFunc("/api/v1/login", o.LoginHandler)
-	mux.HandleFunc("/api/v1/calculate", o.CalculateHandler)
-	mux.HandleFunc("/api/v1/expressions", o.ExpressionsHandler)
-	mux.HandleFunc("/api/v1/expressions/", o.ExpressionByIDHandler)
+	mux.HandleFunc("/api/v1/calculate", o.withIdempotency(o.CalculateHandler))
+	mux.HandleFunc("/api/v1/calculate/batch", o.withIdempotency(o.BatchHandler))
+	mux.HandleFunc("/api/v1/batches/", o.BatchByIDHandler)
+	mux.HandleFunc("/api/v1/imports/", o.ImportJobHandler)
+	mux.HandleFunc("/api/v1/expressions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			o.DeleteExpressionsHandler(w, r)
+			return
+		}
+		o.ExpressionsHandler(w, r)
+	})
+	mux.HandleFunc("/api/v1/expressions/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v1/expressions/export":
+			o.ExportHandler(w, r)
+		case r.URL.Path == "/api/v1/expressions/import":
+			o.ImportHandler(w, r)
+		case strings.HasSuffix(r.URL.Path, "/events"):
+			o.ExpressionEventsHandler(w, r)
+		case r.Method == http.MethodDelete:
+			o.DeleteExpressionHandler(w, r)
+		default:
+			o.ExpressionByIDHandler(w, r)
+		}
+	})
+	mux.HandleFunc("/api/v1/ws", o.WebSocketHandler)
+	mux.HandleFunc("/api/v1/webhook", o.WebhookHandler)
+	mux.HandleFunc("/api/v1/retention", o.RetentionHandler)
+	mux.HandleFunc("/api/v1/webhooks/deliveries", o.DeliveriesHandler)
+	mux.HandleFunc("/internal/agents", o.AgentsHandler)
+	mux.HandleFunc("/internal/agents/", o.AgentHandler)
+	mux.HandleFunc("/internal/queue", o.QueueHandler)
+	mux.HandleFunc("/internal/cache", o.CacheHandler)
 	mux.HandleFunc("/internal/task", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			o.GetTaskHandler(w, r)
@@ -478,21 +1235,28 @@ func (o *Orchestrator) RunServer() error {
 		} else if r.Method == http.MethodPost {
 			o.PostTaskHandler(w, r)
 		} else {
-			http.Error(w, `{"error":"Wrong Method: Need a POST or GET Method"}`, http.StatusMethodNotAllowed)
+			writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a POST or GET Method")
 		}
 	})
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, `{"error":"Not Found"}`, http.StatusNotFound)
+		writeError(w, http.StatusNotFound, "Not Found")
 	})
+	return o.AuthMiddleware(mux)
+}
+
+func (o *Orchestrator) RunServer() error {
+	go o.expireLeases()
+	go o.deliverWebhooks()
+	go o.enforceRetention()
 	go func() {
 		for {
 			time.Sleep(2 * time.Second)
 			o.mu.Lock()
-			if len(o.TaskQueue) > 0 {
-				log.Printf("Pending tasks in queue: %d", len(o.TaskQueue))
+			if o.TaskQueue.Len() > 0 {
+				log.Printf("Pending tasks in queue: %d", o.TaskQueue.Len())
 			}
 			o.mu.Unlock()
 		}
 	}()
-	return http.ListenAndServe(":"+o.Config.Addr, o.AuthMiddleware(mux))
+	return http.ListenAndServe(":"+o.Config.Addr, o.Handler())
 }
@@ -0,0 +1,153 @@
+package orchestrator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+)
+
+// DeleteExpressionHandler serves DELETE /api/v1/expressions/{id}. An
+// unfinished expression is cancelled before it is removed.
+func (o *Orchestrator) DeleteExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	id, err := expressionID(r.URL.Path, "")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid expression ID")
+		return
+	}
+	err = o.cancelExpression(userID, strconv.Itoa(id))
+	if err != nil && !errors.Is(err, errExpressionNotFound) && !errors.Is(err, errExpressionFinished) {
+		writeError(w, http.StatusInternalServerError, "Failed to delete expression")
+		return
+	}
+	if err := o.Database.DeleteExpression(r.Context(), id, userID); err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "Expression not found")
+			return
+		}
+		storageError(w, err, "Failed to delete expression")
+		return
+	}
+	o.forgetExpressions([]int{id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteExpressionsHandler serves DELETE /api/v1/expressions: it removes the
+// finished expressions of the user matching the status, from, to and q
+// filters. At least one filter is required.
+func (o *Orchestrator) DeleteExpressionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	filter, err := expressionFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.Empty() {
+		writeError(w, http.StatusBadRequest, "At least one of status, from, to and q is required")
+		return
+	}
+	ids, err := o.Database.DeleteExpressions(r.Context(), userID, filter)
+	if err != nil {
+		storageError(w, err, "Failed to delete expressions")
+		return
+	}
+	o.forgetExpressions(ids)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"deleted": len(ids)})
+}
+
+// forgetExpressions drops deleted expressions from memory.
+func (o *Orchestrator) forgetExpressions(ids []int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, id := range ids {
+		delete(o.exprStore, strconv.Itoa(id))
+	}
+}
+
+// enforceRetention periodically applies the retention policy.
+func (o *Orchestrator) enforceRetention() {
+	ticker := time.NewTicker(time.Duration(o.Config.RetentionInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := o.ApplyRetention(time.Now()); err != nil {
+			log.Printf("Failed to apply retention policy: %v", err)
+		}
+	}
+}
+
+// ApplyRetention removes finished expressions older than
+// Config.RetentionMaxAge and those beyond the Config.RetentionMaxCount most
+// recent expressions of each user, unless the user overrides a limit. It
+// returns the number of removed expressions.
+func (o *Orchestrator) ApplyRetention(now time.Time) (int, error) {
+	maxAge := time.Duration(o.Config.RetentionMaxAge) * time.Millisecond
+	ids, err := o.Database.PurgeExpressions(context.Background(), now, maxAge, o.Config.RetentionMaxCount)
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) > 0 {
+		log.Printf("Retention policy removed %d expressions", len(ids))
+		o.forgetExpressions(ids)
+	}
+	return len(ids), nil
+}
+
+// RetentionHandler serves /api/v1/retention, the retention policy of the
+// user: GET returns it, PUT sets it and DELETE falls back to the global one.
+// A null limit falls back to the global one and 0 disables it.
+func (o *Orchestrator) RetentionHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		retention, err := o.Database.GetRetention(r.Context(), userID)
+		if err != nil {
+			storageError(w, err, "Failed to get retention policy")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(retention)
+	case http.MethodPut:
+		var body database.Retention
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || negative(body.MaxAge) || negative(body.MaxCount) {
+			writeError(w, http.StatusUnprocessableEntity, "max_age_ms and max_count must be non-negative integers or null")
+			return
+		}
+		if err := o.Database.SetRetention(r.Context(), userID, body); err != nil {
+			storageError(w, err, "Failed to set retention policy")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	case http.MethodDelete:
+		if err := o.Database.SetRetention(r.Context(), userID, database.Retention{}); err != nil {
+			storageError(w, err, "Failed to delete retention policy")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method")
+	}
+}
+
+func negative(v *int) bool {
+	return v != nil && *v < 0
+}
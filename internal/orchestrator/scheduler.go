@@ -0,0 +1,288 @@
+package orchestrator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Scheduler decides in which order queued tasks are handed out to agents.
+// Implementations are not safe for concurrent use; the orchestrator calls
+// them with o.mu held.
+type Scheduler interface {
+	// Push queues a task that just became ready.
+	Push(task *Task)
+	// Requeue returns a task to the queue after its lease was released. It is
+	// served before otherwise equally ranked tasks that were pushed later.
+	Requeue(task *Task)
+	// Pop removes and returns the next task accepted by accept, or nil when
+	// there is none. A nil accept accepts every task.
+	Pop(accept func(*Task) bool) *Task
+	// Remove drops a queued task, e.g. once it has been completed.
+	Remove(task *Task)
+	// Len returns the number of queued tasks.
+	Len() int
+	// Depth returns the number of queued tasks per user.
+	Depth() map[string]int
+}
+
+// NewScheduler returns the scheduler for a policy name: "fair" (the default),
+// "fifo" or "critical-path".
+func NewScheduler(policy string) (Scheduler, error) {
+	switch policy {
+	case "", "fair":
+		return NewFairScheduler(), nil
+	case "fifo":
+		return NewFIFOScheduler(), nil
+	case "critical-path":
+		return NewCriticalPathScheduler(), nil
+	default:
+		return nil, fmt.Errorf("unknown scheduler %q", policy)
+	}
+}
+
+// maxPriority bounds the priority of an expression in both directions, so a
+// client cannot push its tasks ahead of every other priority.
+const maxPriority = 100
+
+// taskList keeps tasks sorted by before.
+type taskList struct {
+	tasks  []*Task
+	before func(a, b *Task) bool
+}
+
+// taskBefore orders tasks by priority and then by queueing order.
+func taskBefore(a, b *Task) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.seq < b.seq
+}
+
+// criticalPathBefore orders tasks by priority, then by the remaining path to
+// the root of their expression and then by queueing order.
+func criticalPathBefore(a, b *Task) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if a.Weight != b.Weight {
+		return a.Weight > b.Weight
+	}
+	return a.seq < b.seq
+}
+
+func (l *taskList) insert(task *Task) {
+	i := sort.Search(len(l.tasks), func(i int) bool { return l.before(task, l.tasks[i]) })
+	l.tasks = append(l.tasks, nil)
+	copy(l.tasks[i+1:], l.tasks[i:])
+	l.tasks[i] = task
+}
+
+func (l *taskList) pop(accept func(*Task) bool) *Task {
+	for i, task := range l.tasks {
+		if accept == nil || accept(task) {
+			l.tasks = append(l.tasks[:i], l.tasks[i+1:]...)
+			return task
+		}
+	}
+	return nil
+}
+
+func (l *taskList) remove(task *Task) {
+	for i, t := range l.tasks {
+		if t == task {
+			l.tasks = append(l.tasks[:i], l.tasks[i+1:]...)
+			return
+		}
+	}
+}
+
+// sequencer numbers pushed tasks upwards and requeued tasks downwards so
+// requeued ones sort first within their priority.
+type sequencer struct {
+	back, front int64
+}
+
+func (s *sequencer) push(task *Task) {
+	s.back++
+	task.seq = s.back
+}
+
+func (s *sequencer) requeue(task *Task) {
+	s.front--
+	task.seq = s.front
+}
+
+// FIFOScheduler hands out tasks by priority and then in arrival order,
+// regardless of which user they belong to.
+type FIFOScheduler struct {
+	sequencer
+	tasks taskList
+}
+
+func NewFIFOScheduler() *FIFOScheduler {
+	return &FIFOScheduler{tasks: taskList{before: taskBefore}}
+}
+
+func (s *FIFOScheduler) Push(task *Task) {
+	s.push(task)
+	s.tasks.insert(task)
+}
+
+func (s *FIFOScheduler) Requeue(task *Task) {
+	s.requeue(task)
+	s.tasks.insert(task)
+}
+
+func (s *FIFOScheduler) Pop(accept func(*Task) bool) *Task {
+	return s.tasks.pop(accept)
+}
+
+func (s *FIFOScheduler) Remove(task *Task) {
+	s.tasks.remove(task)
+}
+
+func (s *FIFOScheduler) Len() int {
+	return len(s.tasks.tasks)
+}
+
+func (s *FIFOScheduler) Depth() map[string]int {
+	depth := make(map[string]int)
+	for _, task := range s.tasks.tasks {
+		depth[task.UserID]++
+	}
+	return depth
+}
+
+// CriticalPathScheduler is a single queue that, within a priority, serves the
+// tasks with the longest remaining path to the root of their expression first
+// (see Task.Weight). Finishing the longest chain early shortens the time until
+// deep, unbalanced expressions are done.
+type CriticalPathScheduler struct {
+	FIFOScheduler
+}
+
+func NewCriticalPathScheduler() *CriticalPathScheduler {
+	return &CriticalPathScheduler{FIFOScheduler{tasks: taskList{before: criticalPathBefore}}}
+}
+
+// FairScheduler keeps a queue per user and serves users round-robin, so a
+// user with a huge expression cannot starve everyone else. Within a user's
+// queue tasks are ordered by priority and then by arrival.
+type FairScheduler struct {
+	sequencer
+	queues map[string]*taskList
+	users  []string
+	next   int
+	len    int
+}
+
+func NewFairScheduler() *FairScheduler {
+	return &FairScheduler{queues: make(map[string]*taskList)}
+}
+
+func (s *FairScheduler) queue(userID string) *taskList {
+	q, ok := s.queues[userID]
+	if !ok {
+		q = &taskList{before: taskBefore}
+		s.queues[userID] = q
+		s.users = append(s.users, userID)
+	}
+	return q
+}
+
+func (s *FairScheduler) Push(task *Task) {
+	s.push(task)
+	s.queue(task.UserID).insert(task)
+	s.len++
+}
+
+func (s *FairScheduler) Requeue(task *Task) {
+	s.requeue(task)
+	s.queue(task.UserID).insert(task)
+	s.len++
+}
+
+func (s *FairScheduler) Pop(accept func(*Task) bool) *Task {
+	for i := 0; i < len(s.users); i++ {
+		idx := (s.next + i) % len(s.users)
+		q := s.queues[s.users[idx]]
+		task := q.pop(accept)
+		if task == nil {
+			continue
+		}
+		s.len--
+		s.next = idx + 1
+		if len(q.tasks) == 0 {
+			s.dropUser(idx)
+		}
+		return task
+	}
+	return nil
+}
+
+func (s *FairScheduler) Remove(task *Task) {
+	q, ok := s.queues[task.UserID]
+	if !ok {
+		return
+	}
+	before := len(q.tasks)
+	q.remove(task)
+	s.len -= before - len(q.tasks)
+	if len(q.tasks) == 0 {
+		for idx, user := range s.users {
+			if user == task.UserID {
+				s.dropUser(idx)
+				break
+			}
+		}
+	}
+}
+
+// dropUser forgets the user at idx in the round-robin order once its queue
+// is empty, keeping the cursor on the user that would have been served next.
+func (s *FairScheduler) dropUser(idx int) {
+	delete(s.queues, s.users[idx])
+	s.users = append(s.users[:idx], s.users[idx+1:]...)
+	if idx < s.next {
+		s.next--
+	}
+	if s.next >= len(s.users) {
+		s.next = 0
+	}
+}
+
+func (s *FairScheduler) Len() int {
+	return s.len
+}
+
+func (s *FairScheduler) Depth() map[string]int {
+	depth := make(map[string]int, len(s.queues))
+	for user, q := range s.queues {
+		depth[user] = len(q.tasks)
+	}
+	return depth
+}
+
+// QueueHandler serves GET /internal/queue: the number of queued tasks in total
+// and per user, and the tasks no live agent can compute.
+func (o *Orchestrator) QueueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a GET Method")
+		return
+	}
+	o.mu.Lock()
+	o.markStuckTasks(time.Now())
+	total, users, stuck := o.TaskQueue.Len(), o.TaskQueue.Depth(), o.stuckTasks()
+	o.mu.Unlock()
+	o.flushWrites()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"scheduler": o.Config.Scheduler,
+		"total":     total,
+		"users":     users,
+		"stuck":     stuck,
+	})
+}
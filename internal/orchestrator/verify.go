@@ -0,0 +1,115 @@
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// maxVerifyReplicas caps the number of agents a single task can be sent to
+// for verification.
+const maxVerifyReplicas = 9
+
+var errTaskNotLeased = errors.New("task is not leased by this agent")
+
+// voteKey identifies equal answers: results are compared exactly and errors
+// by their message.
+func (r TaskResult) voteKey() string {
+	if r.Error != "" {
+		return "error:" + r.Error
+	}
+	return strconv.FormatFloat(r.Result, 'g', -1, 64)
+}
+
+// vote records the answer of agentID for a task that needs verification and
+// applies the result once a quorum of agents agrees on it. Agents that
+// disagree with the quorum are quarantined. When every replica answered
+// without a quorum the task is sent to one more agent, up to
+// maxVerifyReplicas. It must be called with o.mu held.
+func (o *Orchestrator) vote(task *Task, agentID string, res TaskResult) error {
+	if _, leased := task.leases[agentID]; !leased || agentID == "" {
+		return errTaskNotLeased
+	}
+	delete(task.leases, agentID)
+	if len(task.leases) == 0 {
+		delete(o.leases, task.ID)
+	}
+	if task.votes == nil {
+		task.votes = make(map[string]TaskResult)
+	}
+	task.votes[agentID] = res
+
+	counts := make(map[string]int)
+	var winner *TaskResult
+	for _, v := range task.votes {
+		counts[v.voteKey()]++
+		if counts[v.voteKey()] >= task.quorum {
+			v := v
+			winner = &v
+			break
+		}
+	}
+
+	if winner == nil {
+		if task.assignments() < task.Replicas {
+			return nil
+		}
+		if task.Replicas < maxVerifyReplicas {
+			task.Replicas++
+			log.Printf("No quorum for task %s after %d results, asking one more agent", task.ID, len(task.votes))
+			o.requeue(task)
+			return nil
+		}
+		log.Printf("No quorum for task %s after %d results, giving up", task.ID, len(task.votes))
+		o.finishTask(task)
+		o.applyResult(task, TaskResult{ID: task.ID, Error: "results could not be verified"})
+		return nil
+	}
+
+	var dissenters []string
+	for id, v := range task.votes {
+		if v.voteKey() != winner.voteKey() {
+			dissenters = append(dissenters, id)
+		}
+	}
+	o.finishTask(task)
+	for _, id := range dissenters {
+		o.quarantineAgent(id, fmt.Sprintf("task %s: answered %s, quorum agreed on %s",
+			task.ID, task.votes[id].voteKey(), winner.voteKey()))
+	}
+	o.applyResult(task, *winner)
+	return nil
+}
+
+// quarantineAgent stops handing tasks to the agent, ignores its further
+// results and discards the votes and leases it holds. It must be called with
+// o.mu held.
+func (o *Orchestrator) quarantineAgent(agentID, reason string) {
+	if _, ok := o.quarantined[agentID]; ok {
+		return
+	}
+	log.Printf("Quarantining agent %s: %s", agentID, reason)
+	q := quarantine{Reason: reason, Since: time.Now()}
+	if agent, ok := o.agents[agentID]; ok {
+		q.token = agent.token
+	}
+	o.quarantined[agentID] = q
+	for _, task := range o.taskStore {
+		if _, ok := task.votes[agentID]; ok {
+			delete(task.votes, agentID)
+			o.requeue(task)
+		}
+		if _, ok := task.leases[agentID]; ok {
+			o.releaseLease(task, agentID)
+		}
+	}
+}
+
+type quarantine struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	// token is the agent token of the quarantined agent.
+	token string
+}
@@ -0,0 +1,311 @@
+package orchestrator
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+)
+
+const (
+	// webhookTimeout limits a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+	// maxWebhookBackoff caps the delay between two attempts.
+	maxWebhookBackoff = time.Hour
+	// webhookBatch is the number of due deliveries attempted per pass.
+	webhookBatch = 20
+	// webhookWorkers is the number of deliveries attempted at the same time.
+	webhookWorkers = 8
+	// maxDeliveryLog is the number of deliveries returned by the delivery log.
+	maxDeliveryLog = 100
+)
+
+var (
+	errNoWebhookSecret = errors.New("WEBHOOK_SECRET is not set")
+	errPrivateAddress  = errors.New("callback address is not public")
+)
+
+// webhookPayload is the body POSTed to a callback URL.
+type webhookPayload struct {
+	Event      string      `json:"event"`
+	Expression *Expression `json:"expression"`
+	Error      string      `json:"error,omitempty"`
+	Timestamp  time.Time   `json:"timestamp"`
+}
+
+// validCallbackURL reports whether s is an absolute http or https URL. Hosts
+// given as an address that is not public are refused unless
+// Config.WebhookAllowPrivate is set; names are checked once resolved.
+func (o *Orchestrator) validCallbackURL(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	if o.Config.WebhookAllowPrivate {
+		return true
+	}
+	ip := net.ParseIP(u.Hostname())
+	return u.Hostname() != "localhost" && (ip == nil || publicAddress(ip))
+}
+
+// publicAddress reports whether webhooks may be sent to ip. Loopback,
+// link-local, private and unspecified addresses are refused so callback URLs
+// cannot reach services next to the orchestrator.
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
+
+// newWebhookClient returns the client deliveries are sent with. Unless
+// Config.WebhookAllowPrivate is set, it checks the resolved address of every
+// connection, redirects included, and refuses addresses that are not public.
+func (o *Orchestrator) newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if o.Config.WebhookAllowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+				return fmt.Errorf("%w: %s", errPrivateAddress, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: webhookTimeout,
+		},
+	}
+}
+
+// callbackURL returns the URL to notify about a new expression: the one from
+// the request or else the user's default webhook.
+func (o *Orchestrator) callbackURL(ctx context.Context, userID int, requested string) (string, error) {
+	if requested != "" {
+		if o.Config.WebhookSecret == "" {
+			return "", &requestError{"webhooks are disabled: WEBHOOK_SECRET is not set"}
+		}
+		if !o.validCallbackURL(requested) {
+			return "", &requestError{"callback_url must be a public http or https URL"}
+		}
+		return requested, nil
+	}
+	return o.Database.GetWebhook(ctx, userID)
+}
+
+// signWebhook returns the value of the X-Webhook-Signature header for body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhook queues a delivery for a finished expression if it has a
+// callback URL; flushWrites stores it and wakes up the deliverer. Nothing is
+// sent while WEBHOOK_SECRET is not set, since receivers could not verify the
+// delivery. It must be called with o.mu held.
+func (o *Orchestrator) notifyWebhook(expr *Expression, errMsg string) {
+	if expr.CallbackURL == "" {
+		return
+	}
+	if o.Config.WebhookSecret == "" {
+		log.Printf("Not sending webhook for expression %s: %v", expr.ID, errNoWebhookSecret)
+		return
+	}
+	userID, _ := strconv.Atoi(expr.UserID)
+	exprID, _ := strconv.Atoi(expr.ID)
+	event := "expression.completed"
+	if expr.Status == "error" {
+		event = "expression.failed"
+	}
+	now := time.Now()
+	payload, _ := json.Marshal(webhookPayload{Event: event, Expression: expr, Error: errMsg, Timestamp: now})
+	o.pendingDeliveries = append(o.pendingDeliveries, &database.Delivery{
+		UserID:       userID,
+		ExpressionID: exprID,
+		URL:          expr.CallbackURL,
+		Payload:      string(payload),
+		Status:       "pending",
+		NextAttempt:  now,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	})
+}
+
+// deliverWebhooks attempts due deliveries whenever one is stored and once a
+// second for retries.
+func (o *Orchestrator) deliverWebhooks() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.webhooks:
+		}
+		o.DeliverWebhooks(time.Now())
+	}
+}
+
+// DeliverWebhooks makes one attempt for every delivery that is due at now,
+// up to webhookWorkers at a time. Failed attempts are retried with
+// exponential backoff starting at Config.WebhookBackoff until
+// Config.WebhookMaxAttempts is reached.
+func (o *Orchestrator) DeliverWebhooks(now time.Time) {
+	deliveries, err := o.Database.DueDeliveries(context.Background(), now, webhookBatch)
+	if err != nil {
+		log.Printf("Failed to load webhook deliveries: %v", err)
+		return
+	}
+	workers := make(chan struct{}, webhookWorkers)
+	var wg sync.WaitGroup
+	for _, dl := range deliveries {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.attemptDelivery(dl, now)
+			<-workers
+		}()
+	}
+	wg.Wait()
+}
+
+// attemptDelivery sends a delivery once and records the outcome.
+func (o *Orchestrator) attemptDelivery(dl *database.Delivery, now time.Time) {
+	var err error
+	dl.Attempts++
+	dl.ResponseCode, err = o.postWebhook(dl)
+	dl.UpdatedAt = time.Now()
+	switch {
+	case err == nil:
+		dl.Status = "delivered"
+		dl.LastError = ""
+	case dl.Attempts >= o.Config.WebhookMaxAttempts:
+		dl.Status = "failed"
+		dl.LastError = err.Error()
+		log.Printf("Giving up webhook %d for expression %d after %d attempts: %v", dl.ID, dl.ExpressionID, dl.Attempts, err)
+	default:
+		dl.LastError = err.Error()
+		backoff := time.Duration(o.Config.WebhookBackoff) * time.Millisecond << (dl.Attempts - 1)
+		if backoff <= 0 || backoff > maxWebhookBackoff {
+			backoff = maxWebhookBackoff
+		}
+		dl.NextAttempt = now.Add(backoff)
+	}
+	if err := o.Database.UpdateDelivery(context.Background(), dl); err != nil {
+		log.Printf("Failed to update webhook delivery %d: %v", dl.ID, err)
+	}
+}
+
+// postWebhook sends a delivery and returns the response code. Any status
+// outside 2xx is an error. Deliveries are never sent unsigned.
+func (o *Orchestrator) postWebhook(dl *database.Delivery) (int, error) {
+	if o.Config.WebhookSecret == "" {
+		return 0, errNoWebhookSecret
+	}
+	body := []byte(dl.Payload)
+	req, err := http.NewRequest(http.MethodPost, dl.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(dl.ID))
+	req.Header.Set("X-Webhook-Signature", signWebhook(o.Config.WebhookSecret, body))
+	resp, err := o.webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// WebhookHandler serves /api/v1/webhook, the default callback URL of the user:
+// GET returns it, PUT sets it and DELETE removes it.
+func (o *Orchestrator) WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		url, err := o.Database.GetWebhook(r.Context(), userID)
+		if err != nil {
+			storageError(w, err, "Failed to get webhook")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"url": url})
+	case http.MethodPut:
+		var body struct {
+			URL string `json:"url"`
+		}
+		if o.Config.WebhookSecret == "" {
+			writeError(w, http.StatusServiceUnavailable, "Webhooks are disabled: WEBHOOK_SECRET is not set")
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !o.validCallbackURL(body.URL) {
+			writeError(w, http.StatusUnprocessableEntity, "url must be a public http or https URL")
+			return
+		}
+		if err := o.Database.SetWebhook(r.Context(), userID, body.URL); err != nil {
+			storageError(w, err, "Failed to set webhook")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"url": body.URL})
+	case http.MethodDelete:
+		if err := o.Database.SetWebhook(r.Context(), userID, ""); err != nil {
+			storageError(w, err, "Failed to delete webhook")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method")
+	}
+}
+
+// DeliveriesHandler serves GET /api/v1/webhooks/deliveries, the latest webhook
+// deliveries of the user.
+func (o *Orchestrator) DeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Wrong Method: Need a GET Method")
+		return
+	}
+	deliveries, err := o.Database.GetDeliveries(r.Context(), userID, maxDeliveryLog)
+	if err != nil {
+		storageError(w, err, "Failed to get deliveries")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"deliveries": deliveries})
+}
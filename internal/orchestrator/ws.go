@@ -0,0 +1,266 @@
+package orchestrator
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// wsMessage is a message of the /api/v1/ws protocol that is not an Event.
+//
+// Clients send "submit" (expression, replicas, priority), "subscribe" (id) and
+// "cancel" (id); request_id is echoed back in the reply. The server answers
+// with "submitted", "subscribed", "cancelled" or "error" and streams the
+// Events of every submitted or subscribed expression.
+type wsMessage struct {
+	Type       string `json:"type"`
+	RequestID  string `json:"request_id,omitempty"`
+	ID         string `json:"id,omitempty"`
+	Expression string `json:"expression,omitempty"`
+	Replicas   int    `json:"replicas,omitempty"`
+	Priority   int    `json:"priority,omitempty"`
+	Cache      string `json:"cache,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// wsClient is one WebSocket connection of a user.
+type wsClient struct {
+	o      *Orchestrator
+	conn   *websocket.Conn
+	userID int
+	out    chan interface{}
+	// ctx lasts as long as the connection: it is cancelled by stop when
+	// either the read or the write loop ends.
+	ctx  context.Context
+	stop context.CancelFunc
+
+	mu   sync.Mutex
+	subs map[string]bool
+}
+
+// WebSocketHandler serves /api/v1/ws: submitting, tracking and cancelling
+// expressions over a single connection.
+func (o *Orchestrator) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(req).(int)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	ctx, stop := context.WithCancel(r.Context())
+	c := &wsClient{
+		o:      o,
+		conn:   conn,
+		userID: userID,
+		out:    make(chan interface{}, eventBuffer),
+		ctx:    ctx,
+		stop:   stop,
+		subs:   make(map[string]bool),
+	}
+	go c.writeLoop()
+	c.readLoop()
+	stop()
+}
+
+func (c *wsClient) readLoop() {
+	defer c.conn.Close()
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		var msg wsMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("WebSocket of user %d closed: %v", c.userID, err)
+			}
+			return
+		}
+		switch msg.Type {
+		case "submit":
+			c.submit(msg)
+		case "subscribe":
+			c.subscribe(msg)
+		case "cancel":
+			c.cancel(msg)
+		default:
+			c.send(wsMessage{Type: "error", RequestID: msg.RequestID, Error: "unknown message type"})
+		}
+	}
+}
+
+// writeLoop writes the queued messages. Once it fails it closes the
+// connection, which ends readLoop, and releases the senders blocked on a full
+// queue.
+func (c *wsClient) writeLoop() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	defer c.stop()
+	for {
+		select {
+		case msg := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// send queues a message for the client. It returns false once the connection
+// is closed.
+func (c *wsClient) send(msg interface{}) bool {
+	select {
+	case c.out <- msg:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+func (c *wsClient) submit(msg wsMessage) {
+	in := CalculateRequest{Expression: msg.Expression, Replicas: msg.Replicas, Priority: msg.Priority}
+	// Subscribe before the expression starts so no event is lost; the
+	// "submitted" reply is sent once the cache outcome is known.
+	var (
+		events <-chan Event
+		cancel func()
+	)
+	id, cache, err := c.o.submitExpression(c.ctx, c.userID, in, func(id string) {
+		events, cancel = c.o.events.subscribe(id)
+	})
+	if err == nil {
+		c.send(wsMessage{Type: "submitted", RequestID: msg.RequestID, ID: id, Cache: cache})
+		c.follow(id, events, cancel)
+	} else {
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) {
+			err = errors.New("failed to create expression")
+		}
+		c.send(wsMessage{Type: "error", RequestID: msg.RequestID, Error: err.Error()})
+	}
+}
+
+func (c *wsClient) subscribe(msg wsMessage) {
+	id, err := strconv.Atoi(msg.ID)
+	if err != nil {
+		c.send(wsMessage{Type: "error", RequestID: msg.RequestID, ID: msg.ID, Error: "invalid expression ID"})
+		return
+	}
+	// Check ownership before subscribing to the events of the expression.
+	dbExpr, err := c.o.Database.GetExpressionByID(c.ctx, id, c.userID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			err = errExpressionNotFound
+		} else {
+			err = errors.New("failed to get expression")
+		}
+		c.send(wsMessage{Type: "error", RequestID: msg.RequestID, ID: msg.ID, Error: err.Error()})
+		return
+	}
+
+	// Subscribe before reading the current state so no event is lost in between.
+	exprID := strconv.Itoa(id)
+	events, cancel := c.o.events.subscribe(exprID)
+	current := Event{Type: "status", ExprID: exprID, Status: dbExpr.Status, Result: dbExpr.Result}
+	c.o.mu.Lock()
+	expr, live := c.o.exprStore[exprID]
+	if live {
+		current.Status, current.Result = expr.Status, expr.Result
+	}
+	c.o.mu.Unlock()
+	if !live {
+		// The expression may have finished since it was read.
+		if dbExpr, err = c.o.Database.GetExpressionByID(c.ctx, id, c.userID); err != nil {
+			cancel()
+			c.send(wsMessage{Type: "error", RequestID: msg.RequestID, ID: msg.ID, Error: "failed to get expression"})
+			return
+		}
+		current.Status, current.Result = dbExpr.Status, dbExpr.Result
+	}
+
+	c.send(wsMessage{Type: "subscribed", RequestID: msg.RequestID, ID: exprID})
+	if finished(current.Status, current.Result) {
+		current.Type = "done"
+	}
+	// An unfinished expression the orchestrator does not compute, e.g. after
+	// a restart, gets no more events.
+	if !c.send(current) || current.Type == "done" || !live {
+		cancel()
+		return
+	}
+	c.follow(exprID, events, cancel)
+}
+
+func (c *wsClient) cancel(msg wsMessage) {
+	if err := c.o.cancelExpression(c.userID, msg.ID); err != nil {
+		// Finished expressions are only kept in the database.
+		if id, convErr := strconv.Atoi(msg.ID); errors.Is(err, errExpressionNotFound) && convErr == nil {
+			if dbExpr, dbErr := c.o.Database.GetExpressionByID(c.ctx, id, c.userID); dbErr == nil && finished(dbExpr.Status, dbExpr.Result) {
+				err = errExpressionFinished
+			}
+		}
+		c.send(wsMessage{Type: "error", RequestID: msg.RequestID, ID: msg.ID, Error: err.Error()})
+		return
+	}
+	c.send(wsMessage{Type: "cancelled", RequestID: msg.RequestID, ID: msg.ID})
+}
+
+// follow forwards the events of an expression to the client until the
+// expression is done or the connection is closed. An expression is followed
+// at most once per connection.
+func (c *wsClient) follow(id string, events <-chan Event, cancel func()) {
+	c.mu.Lock()
+	if c.subs[id] {
+		c.mu.Unlock()
+		cancel()
+		return
+	}
+	c.subs[id] = true
+	c.mu.Unlock()
+	go func() {
+		defer func() {
+			cancel()
+			c.mu.Lock()
+			delete(c.subs, id)
+			c.mu.Unlock()
+		}()
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok || !c.send(ev) || ev.Type == "done" {
+					return
+				}
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -16,11 +16,17 @@ type Node struct {
 }
 
 func ParseAST(expression string) (*Node, error) {
+	return ParseASTWithVariables(expression, nil)
+}
+
+// ParseASTWithVariables parses an expression in which names such as x or
+// rate_2 stand for the values in vars.
+func ParseASTWithVariables(expression string, vars map[string]float64) (*Node, error) {
 	expr := strings.ReplaceAll(expression, " ", "")
 	if expr == "" {
 		return nil, fmt.Errorf("empty expression")
 	}
-	p := &parser{input: expr, pos: 0}
+	p := &parser{input: expr, pos: 0, vars: vars}
 	node, err := p.parseExpression()
 	if err != nil {
 		return nil, err
@@ -34,6 +40,7 @@ func ParseAST(expression string) (*Node, error) {
 type parser struct {
 	input string
 	pos   int
+	vars  map[string]float64
 }
 
 func (p *parser) peek() rune {
@@ -119,6 +126,9 @@ func (p *parser) parseFactor() (*Node, error) {
 	if ch == '+' || ch == '-' {
 		p.get()
 	}
+	if ch = p.peek(); ch == '_' || unicode.IsLetter(ch) {
+		return p.parseVariable(start)
+	}
 	for {
 		ch = p.peek()
 		if unicode.IsDigit(ch) || ch == '.' {
@@ -140,3 +150,29 @@ func (p *parser) parseFactor() (*Node, error) {
 		Value:  value,
 	}, nil
 }
+
+// parseVariable reads a variable name, optionally signed from start, and
+// returns its value.
+func (p *parser) parseVariable(start int) (*Node, error) {
+	nameStart := p.pos
+	for {
+		ch := p.peek()
+		if ch == '_' || unicode.IsLetter(ch) || unicode.IsDigit(ch) {
+			p.get()
+		} else {
+			break
+		}
+	}
+	name := p.input[nameStart:p.pos]
+	value, ok := p.vars[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %s", name)
+	}
+	if p.input[start] == '-' {
+		value = -value
+	}
+	return &Node{
+		IsLeaf: true,
+		Value:  value,
+	}, nil
+}
@@ -0,0 +1,21 @@
+package calculation
+
+import "strconv"
+
+// Canonical returns a string that is equal for ASTs that evaluate to the same
+// value in the same way: numbers are normalized, every operation is
+// parenthesized and the operands of the commutative + and * are sorted.
+// Operations are never re-associated, so floating point results match.
+func Canonical(node *Node) string {
+	if node == nil {
+		return ""
+	}
+	if node.IsLeaf {
+		return strconv.FormatFloat(node.Value, 'g', -1, 64)
+	}
+	left, right := Canonical(node.Left), Canonical(node.Right)
+	if (node.Operator == "+" || node.Operator == "*") && right < left {
+		left, right = right, left
+	}
+	return "(" + left + node.Operator + right + ")"
+}
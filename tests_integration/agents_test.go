@@ -0,0 +1,99 @@
+package tests_integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Rail-KH/Final_calc/internal/auth"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentRegistry(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	o.Config.OperatorTokens = []string{testOperatorToken}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/calculate", o.CalculateHandler)
+	mux.HandleFunc("/internal/agents", o.AgentsHandler)
+	mux.HandleFunc("/internal/agents/", o.AgentHeartbeatHandler)
+	mux.HandleFunc("/internal/task", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			o.GetTaskHandler(w, r)
+			return
+		}
+		o.PostTaskHandler(w, r)
+	})
+	handler := o.AuthMiddleware(mux)
+
+	do := func(method, path, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+testAgentToken)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/internal/agents", `{"id":"agent-1","hostname":"host","computing_power":2,"operations":["+","-","*","/"],"version":"1.0.0"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var registered struct {
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
+	}
+	json.NewDecoder(w.Body).Decode(&registered)
+	assert.Equal(t, "agent-1", registered.ID)
+	assert.NotEmpty(t, registered.Secret)
+	secret := registered.Secret
+
+	assert.Equal(t, http.StatusOK, do("POST", "/internal/agents/agent-1/heartbeat", "", "X-Agent-Secret", secret).Code)
+	assert.Equal(t, http.StatusForbidden, do("POST", "/internal/agents/agent-1/heartbeat", "").Code)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/internal/agents/unknown/heartbeat", "").Code)
+
+	// The ID of a live agent cannot be taken over without its secret.
+	assert.Equal(t, http.StatusConflict, do("POST", "/internal/agents", `{"id":"agent-1"}`).Code)
+	assert.Equal(t, http.StatusConflict, do("POST", "/internal/agents", `{"id":"agent-1"}`, "X-Agent-Secret", "guess").Code)
+	w = do("POST", "/internal/agents", `{"id":"agent-1","computing_power":2}`, "X-Agent-Secret", secret)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), `"secret":"`+secret+`"`)
+	assert.Equal(t, http.StatusForbidden, do("GET", "/internal/task", "", "X-Agent-ID", "agent-1", "X-Agent-Secret", "guess").Code)
+
+	o.Database.InsertUser(context.Background(), "fleetuser", "fleetpass")
+	user, _ := o.Database.SelectUser(context.Background(), "fleetuser")
+	token, _ := auth.GenJWT(int(user.ID))
+	assert.Equal(t, http.StatusCreated, do("POST", "/api/v1/calculate", `{"expression":"2*3"}`, "Authorization", "Bearer "+token).Code)
+
+	w = do("GET", "/internal/task?max=1", "", "X-Agent-ID", "agent-1", "X-Agent-Secret", secret)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var fetched struct {
+		Tasks []orch.Task `json:"tasks"`
+	}
+	json.NewDecoder(w.Body).Decode(&fetched)
+
+	type fleet struct {
+		Agents []struct {
+			ID             string   `json:"id"`
+			ComputingPower int      `json:"computing_power"`
+			InFlight       []string `json:"in_flight"`
+			CompletedTasks int      `json:"completed_tasks"`
+		} `json:"agents"`
+	}
+	var list fleet
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/internal/agents", "").Code, "the list needs an operator token")
+	json.NewDecoder(do("GET", "/internal/agents", "", "Authorization", "Bearer "+testOperatorToken).Body).Decode(&list)
+	assert.Len(t, list.Agents, 1)
+	assert.Equal(t, 2, list.Agents[0].ComputingPower)
+	assert.Equal(t, []string{fetched.Tasks[0].ID}, list.Agents[0].InFlight)
+
+	do("POST", "/internal/task", `{"id":"`+fetched.Tasks[0].ID+`","result":6}`, "X-Agent-ID", "agent-1", "X-Agent-Secret", secret)
+	list = fleet{}
+	json.NewDecoder(do("GET", "/internal/agents", "", "Authorization", "Bearer "+testOperatorToken).Body).Decode(&list)
+	assert.Empty(t, list.Agents[0].InFlight)
+	assert.Equal(t, 1, list.Agents[0].CompletedTasks)
+}
@@ -0,0 +1,88 @@
+package tests_integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	agentpkg "github.com/Rail-KH/Final_calc/internal/agent"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchSubmission(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "batchuser")
+	otherToken := userToken(t, o, "batchother")
+
+	user := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(handler, method, path, body, "Authorization", "Bearer "+token)
+	}
+
+	w := user("POST", "/api/v1/calculate/batch", `{"expressions":["2*3","2+",{"expression":"1+1","priority":5},{"expression":"1+1","replicas":42}]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		BatchID string `json:"batch_id"`
+		Items   []struct {
+			ID    string `json:"id"`
+			Error string `json:"error"`
+		} `json:"items"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	assert.Len(t, created.Items, 4)
+	assert.NotEmpty(t, created.Items[0].ID)
+	assert.NotEmpty(t, created.Items[1].Error)
+	assert.NotEmpty(t, created.Items[2].ID)
+	assert.Contains(t, created.Items[3].Error, "replicas")
+	assert.Equal(t, 2, o.TaskQueue.Len())
+
+	type batch struct {
+		Batch struct {
+			Status      string         `json:"status"`
+			Total       int            `json:"total"`
+			Done        int            `json:"done"`
+			Counts      map[string]int `json:"counts"`
+			Expressions []struct {
+				ID     string   `json:"id"`
+				Result *float64 `json:"result"`
+			} `json:"expressions"`
+		} `json:"batch"`
+	}
+	get := func() batch {
+		var b batch
+		w := user("GET", "/api/v1/batches/"+created.BatchID, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		json.NewDecoder(w.Body).Decode(&b)
+		return b
+	}
+	b := get()
+	assert.Equal(t, "running", b.Batch.Status)
+	assert.Equal(t, 2, b.Batch.Total)
+	assert.Equal(t, 2, b.Batch.Counts["pending"])
+	assert.Equal(t, created.Items[0].ID, b.Batch.Expressions[0].ID)
+
+	for i := 0; i < 2; i++ {
+		var fetched struct {
+			Task orch.Task `json:"task"`
+		}
+		agent := func(method, path, body string) *httptest.ResponseRecorder {
+			return serve(handler, method, path, body, "Authorization", "Bearer "+testAgentToken)
+		}
+		json.NewDecoder(agent("GET", "/internal/task", "").Body).Decode(&fetched)
+		value, _ := agentpkg.Calc(fetched.Task.Operation, fetched.Task.Arg1, fetched.Task.Arg2)
+		result, _ := json.Marshal(map[string]interface{}{"id": fetched.Task.ID, "result": value})
+		agent("POST", "/internal/task", string(result))
+	}
+	b = get()
+	assert.Equal(t, "completed", b.Batch.Status)
+	assert.Equal(t, 2, b.Batch.Done)
+	assert.Equal(t, 2, b.Batch.Counts["completed"])
+
+	w = serve(handler, "GET", "/api/v1/batches/"+created.BatchID, "", "Authorization", "Bearer "+otherToken)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, user("POST", "/api/v1/calculate/batch", `{"expressions":["2+"]}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, user("POST", "/api/v1/calculate/batch", `{"expressions":[]}`).Code)
+}
@@ -0,0 +1,151 @@
+package tests_integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/Rail-KH/Final_calc/internal/agent"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultCache(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "cacheuser")
+	otherToken := userToken(t, o, "cacheother")
+
+	submit := func(token, body string) (string, string) {
+		w := serve(handler, "POST", "/api/v1/calculate", body, "Authorization", "Bearer "+token)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var resp struct {
+			ID    string `json:"id"`
+			Cache string `json:"cache"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.ID, resp.Cache
+	}
+	expression := func(token, id string) orch.Expression {
+		var resp struct {
+			Expression orch.Expression `json:"expression"`
+		}
+		w := serve(handler, "GET", "/api/v1/expressions/"+id, "", "Authorization", "Bearer "+token)
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Expression
+	}
+
+	first, cache := submit(token, `{"expression":"(7*6)-1"}`)
+	assert.Equal(t, "miss", cache)
+	shared, cache := submit(otherToken, `{"expression":"(6*7)-1"}`)
+	assert.Equal(t, "shared", cache, "an identical running expression shares its tasks")
+	assert.Equal(t, 1, o.TaskQueue.Len())
+
+	for _, result := range []string{"42", "41"} {
+		var fetched struct {
+			Task orch.Task `json:"task"`
+		}
+		w := serve(handler, "GET", "/internal/task", "", "Authorization", "Bearer "+testAgentToken)
+		json.NewDecoder(w.Body).Decode(&fetched)
+		serve(handler, "POST", "/internal/task", `{"id":"`+fetched.Task.ID+`","result":`+result+`}`, "Authorization", "Bearer "+testAgentToken)
+	}
+	for _, e := range []orch.Expression{expression(token, first), expression(otherToken, shared)} {
+		assert.Equal(t, "completed", e.Status)
+		if assert.NotNil(t, e.Result) {
+			assert.Equal(t, 41.0, *e.Result)
+		}
+	}
+
+	hit, cache := submit(token, `{"expression":"6 * 7 - 1"}`)
+	assert.Equal(t, "hit", cache)
+	assert.Equal(t, 0, o.TaskQueue.Len(), "a cached result schedules no tasks")
+	e := expression(token, hit)
+	assert.Equal(t, "completed", e.Status)
+	if assert.NotNil(t, e.Result) {
+		assert.Equal(t, 41.0, *e.Result)
+	}
+
+	_, cache = submit(token, `{"expression":"1-(6*7)"}`)
+	assert.Equal(t, "miss", cache, "subtraction is not commutative")
+	_, cache = submit(token, `{"expression":"(7*6)-1","replicas":2}`)
+	assert.Equal(t, "miss", cache, "a result verified by fewer agents is not reused")
+}
+
+func TestTaskMemo(t *testing.T) {
+	t.Setenv("RESULT_CACHE_SIZE", "0")
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "memouser")
+
+	submit := func(expression string) string {
+		w := serve(handler, "POST", "/api/v1/calculate", `{"expression":"`+expression+`"}`, "Authorization", "Bearer "+token)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var resp struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.ID
+	}
+	compute := func() {
+		var fetched struct {
+			Task orch.Task `json:"task"`
+		}
+		w := serve(handler, "GET", "/internal/task", "", "Authorization", "Bearer "+testAgentToken)
+		if w.Code != http.StatusOK {
+			t.Fatalf("no task: %d", w.Code)
+		}
+		json.NewDecoder(w.Body).Decode(&fetched)
+		result, _ := agent.Calc(fetched.Task.Operation, fetched.Task.Arg1, fetched.Task.Arg2)
+		body := fmt.Sprintf(`{"id":"%s","result":%v}`, fetched.Task.ID, result)
+		serve(handler, "POST", "/internal/task", body, "Authorization", "Bearer "+testAgentToken)
+	}
+	stats := func() (hits, misses int64) {
+		var resp struct {
+			Tasks struct {
+				Hits   int64 `json:"hits"`
+				Misses int64 `json:"misses"`
+			} `json:"tasks"`
+		}
+		w := serve(handler, "GET", "/internal/cache", "", "Authorization", "Bearer "+testAgentToken)
+		assert.Equal(t, http.StatusOK, w.Code)
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Tasks.Hits, resp.Tasks.Misses
+	}
+
+	submit("1234.5*678.9+1")
+	compute()
+	compute()
+	assert.Equal(t, 0, o.TaskQueue.Len())
+	hits, _ := stats()
+	assert.Equal(t, int64(0), hits)
+
+	id := submit("1+678.9*1234.5")
+	assert.Equal(t, 0, o.TaskQueue.Len(), "memoized subtrees resolve their parents without tasks")
+	w := serve(handler, "GET", "/api/v1/expressions/"+id, "", "Authorization", "Bearer "+token)
+	var resp struct {
+		Expression orch.Expression `json:"expression"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	assert.Equal(t, "completed", resp.Expression.Status)
+	if assert.NotNil(t, resp.Expression.Result) {
+		assert.InDelta(t, 838103.05, *resp.Expression.Result, 1e-6)
+	}
+
+	submit("(1234.5*678.9)/2")
+	assert.Equal(t, 1, o.TaskQueue.Len(), "only the division is computed")
+	hits, misses := stats()
+	assert.Equal(t, int64(3), hits)
+	assert.Equal(t, int64(3), misses)
+
+	// Completing one task of an expression must not look its other scheduled
+	// tasks up again.
+	submit("(5+6)*(7+8)")
+	compute()
+	compute()
+	hits, misses = stats()
+	assert.Equal(t, int64(3), hits)
+	assert.Equal(t, int64(5), misses, "nodes that already have a task are not looked up")
+}
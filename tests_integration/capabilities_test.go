@@ -0,0 +1,122 @@
+package tests_integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperationRouting(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "routinguser")
+
+	agent := agentClient(handler)
+	stuck := func() []string {
+		var resp struct {
+			Stuck []struct {
+				Operation string `json:"operation"`
+			} `json:"stuck"`
+		}
+		json.NewDecoder(agent("GET", "/internal/queue", "", "").Body).Decode(&resp)
+		ops := []string{}
+		for _, task := range resp.Stuck {
+			ops = append(ops, task.Operation)
+		}
+		return ops
+	}
+	status := func(id string) string {
+		var resp struct {
+			Expression struct {
+				Status string `json:"status"`
+			} `json:"expression"`
+		}
+		w := serve(handler, "GET", "/api/v1/expressions/:"+id, "", "Authorization", "Bearer "+token)
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Expression.Status
+	}
+
+	assert.Equal(t, http.StatusCreated, agent("POST", "/internal/agents", `{"id":"adder","operations":["+"]}`, "adder").Code)
+	w := serve(handler, "POST", "/api/v1/calculate", `{"expression":"2+3*4"}`, "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+
+	assert.Equal(t, []string{"*"}, stuck())
+	assert.Equal(t, "stuck", status(created.ID))
+	assert.Equal(t, http.StatusNotFound, agent("GET", "/internal/task?max=5", "", "adder").Code)
+
+	// Advertising operations on fetch overrides the registered ones.
+	assert.Equal(t, http.StatusCreated, agent("POST", "/internal/agents", `{"id":"multiplier"}`, "multiplier").Code)
+	assert.Equal(t, http.StatusNotFound, agent("GET", "/internal/task?ops=-,/", "", "multiplier").Code)
+	assert.Equal(t, []string{"*"}, stuck())
+
+	w = agent("GET", "/internal/task?ops=*", "", "multiplier")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var fetched struct {
+		Task orch.Task `json:"task"`
+	}
+	json.NewDecoder(w.Body).Decode(&fetched)
+	assert.Equal(t, "*", fetched.Task.Operation)
+	assert.Empty(t, stuck())
+	assert.NotEqual(t, "stuck", status(created.ID))
+
+	agent("POST", "/internal/task", `{"id":"`+fetched.Task.ID+`","result":12}`, "multiplier")
+	w = agent("GET", "/internal/task", "", "adder")
+	assert.Equal(t, http.StatusOK, w.Code)
+	json.NewDecoder(w.Body).Decode(&fetched)
+	assert.Equal(t, "+", fetched.Task.Operation)
+}
+
+func TestStuckNeedsKnownFleet(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "fleetuser")
+
+	agent := agentClient(handler)
+	stuck := func() int {
+		var resp struct {
+			Stuck []struct{} `json:"stuck"`
+		}
+		json.NewDecoder(agent("GET", "/internal/queue", "", "").Body).Decode(&resp)
+		return len(resp.Stuck)
+	}
+
+	assert.Equal(t, http.StatusCreated, serve(handler, "POST", "/api/v1/calculate", `{"expression":"2*3"}`, "Authorization", "Bearer "+token).Code)
+	assert.Equal(t, 0, stuck(), "without registered agents nothing is known to be stuck")
+
+	// An agent that did not register may compute anything.
+	o.Config.AgentTimeout = 100
+	assert.Equal(t, http.StatusNotFound, agent("GET", "/internal/task?ops=-", "", "").Code)
+	assert.Equal(t, http.StatusCreated, agent("POST", "/internal/agents", `{"id":"adder","operations":["+"]}`, "adder").Code)
+	assert.Equal(t, 0, stuck())
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, 1, stuck())
+}
+
+func TestLongPollKeepsOperations(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "longpolluser")
+
+	agent := agentClient(handler)
+	polled := make(chan int)
+	go func() {
+		polled <- agent("GET", "/internal/task?ops=%2B&wait=500ms", "", "").Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusCreated, serve(handler, "POST", "/api/v1/calculate", `{"expression":"2*3"}`, "Authorization", "Bearer "+token).Code)
+	assert.Equal(t, http.StatusNotFound, <-polled, "an adder that waited is not handed a multiplication")
+
+	w := agent("GET", "/internal/task?ops=*", "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,51 @@
+package tests_integration
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/auth"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorResponses(t *testing.T) {
+	o := orch.NewOrchestrator()
+	handler := o.Handler()
+	login := "erroruser-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	token := userToken(t, o, login)
+	unknownToken, _ := auth.GenJWT(1 << 30)
+
+	tests := []struct {
+		name, method, path, body, token string
+		code                            int
+	}{
+		{"duplicate login", "POST", "/api/v1/register", `{"login":"` + login + `","password":"pass"}`, "", http.StatusConflict},
+		{"unknown login", "POST", "/api/v1/login", `{"login":"missing-` + login + `","password":"pass"}`, "", http.StatusUnauthorized},
+		{"missing expression", "GET", "/api/v1/expressions/999999", "", token, http.StatusNotFound},
+		{"delete missing expression", "DELETE", "/api/v1/expressions/999999", "", token, http.StatusNotFound},
+		{"missing batch", "GET", "/api/v1/batches/999999", "", token, http.StatusNotFound},
+		{"missing import job", "GET", "/api/v1/imports/999999", "", token, http.StatusNotFound},
+		{"deleted user", "POST", "/api/v1/calculate", `{"expression":"2+2"}`, unknownToken, http.StatusUnauthorized},
+		{"invalid expression", "POST", "/api/v1/calculate", `{"expression":"2+"}`, token, http.StatusUnprocessableEntity},
+		{"invalid cursor", "GET", "/api/v1/expressions?cursor=nope", "", token, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var headers []string
+			if tt.token != "" {
+				headers = []string{"Authorization", "Bearer " + tt.token}
+			}
+			w := serve(handler, tt.method, tt.path, tt.body, headers...)
+			assert.Equal(t, tt.code, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			var body map[string]string
+			assert.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			assert.NotEmpty(t, body["error"])
+			assert.Len(t, body, 1)
+		})
+	}
+}
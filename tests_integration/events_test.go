@@ -0,0 +1,130 @@
+package tests_integration
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpressionEvents(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	token := userToken(t, o, "eventsuser")
+	otherToken := userToken(t, o, "eventsother")
+
+	w := serve(handler, "POST", "/api/v1/calculate", `{"expression":"1+2*3"}`, "Authorization", "Bearer "+token)
+	var created struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	eventsPath := "/api/v1/expressions/" + created.ID + "/events"
+
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, "GET", eventsPath, "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(handler, "GET", eventsPath, "", "Authorization", "Bearer "+otherToken).Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, "GET", server.URL+eventsPath+"?token="+token, nil)
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	stream := bufio.NewScanner(resp.Body)
+	next := func() orch.Event {
+		var ev orch.Event
+		for stream.Scan() {
+			if data, ok := strings.CutPrefix(stream.Text(), "data: "); ok {
+				json.Unmarshal([]byte(data), &ev)
+				return ev
+			}
+		}
+		t.Fatalf("stream ended: %v", stream.Err())
+		return ev
+	}
+	assert.Equal(t, "status", next().Type)
+
+	agent := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(handler, method, path, body, "Authorization", "Bearer "+testAgentToken)
+	}
+	complete := func(result float64) string {
+		var fetched struct {
+			Task orch.Task `json:"task"`
+		}
+		json.NewDecoder(agent("GET", "/internal/task", "").Body).Decode(&fetched)
+		body, _ := json.Marshal(map[string]interface{}{"id": fetched.Task.ID, "result": result})
+		agent("POST", "/internal/task", string(body))
+		return fetched.Task.ID
+	}
+
+	taskID := complete(6)
+	ev := next()
+	assert.Equal(t, "task_completed", ev.Type)
+	assert.Equal(t, taskID, ev.TaskID)
+	assert.Equal(t, 6.0, *ev.Result)
+	ev = next()
+	assert.Equal(t, "task_scheduled", ev.Type)
+	assert.Equal(t, "+", ev.Operation)
+
+	complete(7)
+	assert.Equal(t, "task_completed", next().Type)
+	ev = next()
+	assert.Equal(t, "done", ev.Type)
+	assert.Equal(t, "completed", ev.Status)
+	assert.Equal(t, 7.0, *ev.Result)
+	for stream.Scan() {
+		assert.Empty(t, stream.Text(), "stream ends after the final event")
+	}
+	assert.NoError(t, stream.Err())
+
+	// A finished expression yields a single final event.
+	w = serve(handler, "GET", eventsPath, "", "Authorization", "Bearer "+token)
+	assert.Contains(t, w.Body.String(), "event: done")
+
+	// An unfinished expression the orchestrator does not compute, e.g. after a
+	// restart, yields its stored state and the stream ends.
+	user, _ := o.Database.SelectUser(context.Background(), "eventsuser")
+	orphan, err := o.Database.CreateExpression(context.Background(), int(user.ID), "4+5")
+	assert.NoError(t, err)
+	w = serve(handler, "GET", "/api/v1/expressions/"+strconv.Itoa(orphan.ID)+"/events", "", "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"pending"`)
+}
+
+func TestFinishedExpressionsForgotten(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "forgottenuser")
+
+	w := serve(handler, "POST", "/api/v1/calculate", `{"expression":"2*3"}`, "Authorization", "Bearer "+token)
+	var created struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+	computeAll(handler)
+
+	// Once it is finished, the expression is only read from the database.
+	user, _ := o.Database.SelectUser(context.Background(), "forgottenuser")
+	id, _ := strconv.Atoi(created.ID)
+	assert.NoError(t, o.Database.UpdateExpression(context.Background(), &database.Expression{
+		UserID: int(user.ID), ID: id, Expression: "2*3", Status: "error", Error: "edited",
+	}))
+	w = serve(handler, "GET", "/api/v1/expressions/"+created.ID+"/events", "", "Authorization", "Bearer "+token)
+	assert.Contains(t, w.Body.String(), `"status":"error"`, "the expression is not kept in memory")
+}
@@ -0,0 +1,80 @@
+package tests_integration
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "exportuser-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	for _, expression := range []string{"2*3", "1/0", "2+", "=2+2", "-5+3"} {
+		serve(handler, "POST", "/api/v1/calculate", `{"expression":"`+expression+`"}`, "Authorization", "Bearer "+token)
+	}
+	computeAll(handler)
+	export := func(query string) *http.Response {
+		return serve(handler, "GET", "/api/v1/expressions/export?"+query, "", "Authorization", "Bearer "+token).Result()
+	}
+
+	resp := export("format=csv")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, records, 6) {
+		assert.Equal(t, []string{"id", "expression", "status", "result", "error", "created_at", "updated_at"}, records[0])
+		assert.Equal(t, []string{"2*3", "completed", "6", ""}, records[1][1:5])
+		assert.Equal(t, []string{"1/0", "error", ""}, records[2][1:4])
+		assert.NotEmpty(t, records[2][4], "the error reason is exported")
+		assert.Equal(t, "2+", records[3][1])
+		assert.NotEmpty(t, records[3][4])
+		assert.Equal(t, "'=2+2", records[4][1], "formulas are not exported as formulas")
+		assert.Equal(t, "-5+3", records[5][1], "signed expressions are exported as they are")
+		_, err := time.Parse(time.RFC3339, records[1][5])
+		assert.NoError(t, err)
+	}
+
+	resp = export("format=jsonl&status=error")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var rows []map[string]interface{}
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		var row map[string]interface{}
+		assert.NoError(t, json.Unmarshal(lines.Bytes(), &row))
+		rows = append(rows, row)
+	}
+	if assert.Len(t, rows, 3) {
+		assert.Equal(t, "1/0", rows[0]["expression"])
+		assert.Equal(t, "error", rows[0]["status"])
+		assert.NotEmpty(t, rows[0]["error"])
+		assert.NotEmpty(t, rows[0]["created_at"])
+	}
+
+	assert.Equal(t, http.StatusBadRequest, export("format=xml").StatusCode)
+	assert.Equal(t, http.StatusBadRequest, export("from=yesterday").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, "GET", "/api/v1/expressions/export", "").Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/api/v1/expressions/export", nil).WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "a failure before the first row is reported")
+	assert.Empty(t, w.Header().Get("Content-Disposition"))
+}
@@ -0,0 +1,115 @@
+package tests_integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/agent"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpressionList(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "listuser-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	for _, expression := range []string{"2*3", "7-1", "1/0", "40+2", "9*9"} {
+		w := serve(handler, "POST", "/api/v1/calculate", `{"expression":"`+expression+`"}`, "Authorization", "Bearer "+token)
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	for {
+		w := serve(handler, "GET", "/internal/task", "", "Authorization", "Bearer "+testAgentToken)
+		if w.Code != http.StatusOK {
+			break
+		}
+		var resp struct {
+			Task orch.Task `json:"task"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		var body string
+		if result, err := agent.Calc(resp.Task.Operation, resp.Task.Arg1, resp.Task.Arg2); err != nil {
+			body = fmt.Sprintf(`{"id":"%s","error":%q}`, resp.Task.ID, err.Error())
+		} else {
+			body = fmt.Sprintf(`{"id":"%s","result":%v}`, resp.Task.ID, result)
+		}
+		serve(handler, "POST", "/internal/task", body, "Authorization", "Bearer "+testAgentToken)
+	}
+
+	type page struct {
+		Expressions []orch.Expression `json:"expressions"`
+		NextCursor  string            `json:"next_cursor"`
+	}
+	list := func(params url.Values) (int, page) {
+		var p page
+		w := serve(handler, "GET", "/api/v1/expressions?"+params.Encode(), "", "Authorization", "Bearer "+token)
+		json.NewDecoder(w.Body).Decode(&p)
+		return w.Code, p
+	}
+	// all follows the cursors and returns the expressions of every page.
+	all := func(params url.Values) ([]string, int) {
+		var exprs []string
+		pages := 0
+		for {
+			code, p := list(params)
+			if !assert.Equal(t, http.StatusOK, code) {
+				return exprs, pages
+			}
+			pages++
+			for _, e := range p.Expressions {
+				exprs = append(exprs, e.Expr)
+			}
+			if p.NextCursor == "" {
+				return exprs, pages
+			}
+			params.Set("cursor", p.NextCursor)
+		}
+	}
+
+	exprs, pages := all(url.Values{"limit": {"2"}})
+	assert.Equal(t, []string{"2*3", "7-1", "1/0", "40+2", "9*9"}, exprs)
+	assert.Equal(t, 3, pages)
+
+	exprs, _ = all(url.Values{"limit": {"2"}, "sort": {"expression"}, "order": {"desc"}})
+	assert.Equal(t, []string{"9*9", "7-1", "40+2", "2*3", "1/0"}, exprs)
+
+	exprs, _ = all(url.Values{"status": {"error"}})
+	assert.Equal(t, []string{"1/0"}, exprs)
+	exprs, _ = all(url.Values{"status": {"completed,error"}, "sort": {"status"}, "limit": {"1"}})
+	assert.Len(t, exprs, 5)
+	assert.Equal(t, "1/0", exprs[4])
+
+	exprs, _ = all(url.Values{"q": {"*"}})
+	assert.Equal(t, []string{"2*3", "9*9"}, exprs)
+	exprs, _ = all(url.Values{"q": {"%"}})
+	assert.Empty(t, exprs, "LIKE wildcards are matched literally")
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	exprs, _ = all(url.Values{"from": {future}})
+	assert.Empty(t, exprs)
+	exprs, _ = all(url.Values{"to": {future}, "sort": {"created_at"}, "order": {"desc"}, "limit": {"2"}})
+	assert.Equal(t, []string{"9*9", "40+2", "1/0", "7-1", "2*3"}, exprs)
+
+	_, p := list(url.Values{"limit": {"1"}})
+	if assert.Len(t, p.Expressions, 1) {
+		assert.NotNil(t, p.Expressions[0].CreatedAt)
+	}
+	code, _ := list(url.Values{"cursor": {p.NextCursor}, "sort": {"status"}})
+	assert.Equal(t, http.StatusBadRequest, code, "a cursor only continues its own sort")
+	for _, params := range []url.Values{
+		{"cursor": {"garbage"}},
+		{"limit": {"0"}},
+		{"sort": {"result"}},
+		{"order": {"up"}},
+		{"from": {"yesterday"}},
+	} {
+		code, _ := list(params)
+		assert.Equal(t, http.StatusBadRequest, code, "params: %v", params)
+	}
+}
@@ -0,0 +1,100 @@
+package tests_integration
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Rail-KH/Final_calc/internal/agentpb"
+	"github.com/Rail-KH/Final_calc/internal/auth"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCTransport(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	lis := bufconn.Listen(1 << 20)
+	srv := o.GRPCServer()
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+	client := agentpb.NewAgentServiceClient(conn)
+
+	t.Run("rejects calls without token", func(t *testing.T) {
+		_, err := client.Heartbeat(context.Background(), &agentpb.HeartbeatRequest{AgentId: "agent"})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	o.Database.InsertUser(context.Background(), "grpcuser", "grpcpass")
+	user, _ := o.Database.SelectUser(context.Background(), "grpcuser")
+	token, _ := auth.GenJWT(int(user.ID))
+	req := httptest.NewRequest("POST", "/api/v1/calculate", strings.NewReader(`{"expression":"(1+2)*3"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	o.AuthMiddleware(http.HandlerFunc(o.CalculateHandler)).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+testAgentToken)
+	t.Run("fetch and submit", func(t *testing.T) {
+		fetched, err := client.FetchTasks(ctx, &agentpb.FetchTasksRequest{MaxTasks: 5, WaitMs: 1000})
+		assert.NoError(t, err)
+		assert.Len(t, fetched.Tasks, 1)
+		assert.Equal(t, "+", fetched.Tasks[0].Operation)
+
+		submitted, err := client.SubmitResult(ctx, &agentpb.SubmitResultRequest{
+			Results: []*agentpb.TaskResult{{Id: fetched.Tasks[0].Id, Result: 3}},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "result accepted", submitted.Statuses[0].Status)
+	})
+
+	t.Run("stream pushes ready tasks", func(t *testing.T) {
+		stream, err := client.Connect(ctx)
+		assert.NoError(t, err)
+		defer stream.CloseSend()
+		assert.NoError(t, stream.Send(&agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Credits{Credits: 1}}))
+
+		msg, err := stream.Recv()
+		assert.NoError(t, err)
+		task := msg.GetTask()
+		assert.Equal(t, "*", task.Operation)
+		assert.Equal(t, 3.0, task.Arg1)
+
+		assert.NoError(t, stream.Send(&agentpb.AgentMessage{Payload: &agentpb.AgentMessage_Result{
+			Result: &agentpb.TaskResult{Id: task.Id, Result: 9},
+		}}))
+		msg, err = stream.Recv()
+		assert.NoError(t, err)
+		assert.Equal(t, "result accepted", msg.GetStatus().Status)
+	})
+
+	t.Run("agent secret", func(t *testing.T) {
+		registered, err := client.Register(ctx, &agentpb.RegisterRequest{AgentId: "grpc-agent"})
+		assert.NoError(t, err)
+		assert.NotEmpty(t, registered.AgentSecret)
+
+		_, err = client.Register(ctx, &agentpb.RegisterRequest{AgentId: "grpc-agent"})
+		assert.Equal(t, codes.AlreadyExists, status.Code(err))
+		_, err = client.Heartbeat(ctx, &agentpb.HeartbeatRequest{AgentId: "grpc-agent"})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+		withSecret := metadata.AppendToOutgoingContext(ctx, "agent-secret", registered.AgentSecret)
+		_, err = client.Heartbeat(withSecret, &agentpb.HeartbeatRequest{AgentId: "grpc-agent"})
+		assert.NoError(t, err)
+	})
+}
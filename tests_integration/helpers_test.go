@@ -0,0 +1,77 @@
+package tests_integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Rail-KH/Final_calc/internal/auth"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestMain runs the tests against in-memory storage, so they do not depend on
+// each other, unless DATABASE_URL selects a database. Passwords are hashed
+// with the lowest bcrypt cost, as the tests create many users.
+func TestMain(m *testing.M) {
+	if os.Getenv("DATABASE_URL") == "" {
+		os.Setenv("DATABASE_URL", "memory://")
+	}
+	auth.HashCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+// tempSQLite returns the URL of a new SQLite database in a temporary
+// directory that is removed after the test.
+func tempSQLite(t testing.TB) string {
+	return "sqlite://" + filepath.Join(t.TempDir(), "exp.db")
+}
+
+// serve sends a request to handler. headers are passed as key, value pairs.
+func serve(handler http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// agentClient returns a function that sends agent requests to handler. It
+// remembers the secret issued on registration and sends it with the agent ID.
+func agentClient(handler http.Handler) func(method, path, body, agentID string) *httptest.ResponseRecorder {
+	secrets := map[string]string{}
+	return func(method, path, body, agentID string) *httptest.ResponseRecorder {
+		w := serve(handler, method, path, body, "Authorization", "Bearer "+testAgentToken, "X-Agent-ID", agentID, "X-Agent-Secret", secrets[agentID])
+		if method == http.MethodPost && path == "/internal/agents" && w.Code == http.StatusCreated {
+			var resp struct {
+				ID     string `json:"id"`
+				Secret string `json:"secret"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			secrets[resp.ID] = resp.Secret
+		}
+		return w
+	}
+}
+
+// userToken makes sure the user exists and returns a JWT for it.
+func userToken(t testing.TB, o *orch.Orchestrator, login string) string {
+	t.Helper()
+	o.Database.InsertUser(context.Background(), login, login+"-pass")
+	user, err := o.Database.SelectUser(context.Background(), login)
+	if err != nil {
+		t.Fatalf("failed to get user %s: %v", login, err)
+	}
+	token, err := auth.GenJWT(int(user.ID))
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	return token
+}
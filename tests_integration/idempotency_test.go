@@ -0,0 +1,83 @@
+package tests_integration
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	o := orch.NewOrchestrator()
+	handler := o.Handler()
+	token := userToken(t, o, "idempotentuser")
+	otherToken := userToken(t, o, "idempotentother")
+	key := "key-" + time.Now().Format(time.RFC3339Nano)
+
+	submit := func(token, body, key string) (int, string, bool) {
+		w := serve(handler, "POST", "/api/v1/calculate", body, "Authorization", "Bearer "+token, "Idempotency-Key", key)
+		var resp struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.ID, w.Header().Get("Idempotent-Replayed") == "true"
+	}
+
+	code, id, replayed := submit(token, `{"expression":"2*3"}`, key)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.False(t, replayed)
+	assert.Equal(t, 1, o.TaskQueue.Len())
+
+	code, replayID, replayed := submit(token, `{"expression":"2*3"}`, key)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, id, replayID)
+	assert.True(t, replayed)
+	assert.Equal(t, 1, o.TaskQueue.Len(), "a replay schedules no new tasks")
+
+	code, _, _ = submit(token, `{"expression":"2*4"}`, key)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	code, otherID, replayed := submit(otherToken, `{"expression":"2*3"}`, key)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEqual(t, id, otherID)
+	assert.False(t, replayed, "keys are per user")
+
+	code, _, _ = submit(token, `{"expression":"2+"}`, key+"-invalid")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	code, _, replayed = submit(token, `{"expression":"2+"}`, key+"-invalid")
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.True(t, replayed)
+
+	// A key left reserved by a request that never finished is free again
+	// once its lease has passed.
+	user, _ := o.Database.SelectUser(context.Background(), "idempotentuser")
+	body := `{"expression":"2*5"}`
+	sum := sha256.Sum256([]byte(body))
+	crashed := time.Now()
+	o.Database.ReserveIdempotencyKey(context.Background(), int(user.ID), key+"-crashed", hex.EncodeToString(sum[:]), crashed, crashed.Add(-time.Hour), crashed.Add(-time.Hour))
+	code, _, _ = submit(token, body, key+"-crashed")
+	assert.Equal(t, http.StatusConflict, code)
+	o.Config.IdempotencyLease = 1
+	time.Sleep(5 * time.Millisecond)
+	code, _, replayed = submit(token, body, key+"-crashed")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.False(t, replayed)
+
+	o.Config.IdempotencyTTL = 1
+	time.Sleep(5 * time.Millisecond)
+	code, newID, replayed := submit(token, `{"expression":"2*3"}`, key)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEqual(t, id, newID, "expired keys are forgotten")
+	assert.False(t, replayed)
+
+	huge := `{"expression":"` + strings.Repeat("1+", 1<<19) + `1"}`
+	code, _, _ = submit(token, huge, key+"-huge")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+}
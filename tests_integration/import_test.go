@@ -0,0 +1,175 @@
+package tests_integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImport(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	token := userToken(t, o, "importuser-"+suffix)
+	otherToken := userToken(t, o, "importother-"+suffix)
+
+	upload := func(filename, content string) (int, database.ImportJob) {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("comment", "ignored")
+		part, _ := mw.CreateFormFile("file", filename)
+		part.Write([]byte(content))
+		mw.Close()
+		w := serve(handler, "POST", "/api/v1/expressions/import", body.String(),
+			"Authorization", "Bearer "+token, "Content-Type", mw.FormDataContentType())
+		var resp struct {
+			Job database.ImportJob `json:"job"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Job
+	}
+	report := func(token string, id int, query string) (int, []database.ImportLine) {
+		w := serve(handler, "GET", "/api/v1/imports/"+strconv.Itoa(id)+query, "", "Authorization", "Bearer "+token)
+		var resp struct {
+			Lines []database.ImportLine `json:"lines"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp.Lines
+	}
+
+	code, job := upload("history.csv", "expression,variables\n2*x,x=4\n3+\n\n\"1+2\"\nx*y,x=2,y=oops\n(1\n")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "csv", job.Format)
+	assert.Equal(t, "completed", job.Status)
+	assert.Equal(t, 5, job.Total)
+	assert.Equal(t, 2, job.Accepted)
+	assert.Equal(t, 3, job.Rejected)
+
+	code, lines := report(token, job.ID, "")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, lines, 5) {
+		assert.Equal(t, []int{2, 3, 5, 6, 7}, []int{lines[0].Line, lines[1].Line, lines[2].Line, lines[3].Line, lines[4].Line})
+		assert.NotZero(t, lines[0].ExpressionID)
+		assert.NotEmpty(t, lines[1].Error)
+		assert.NotZero(t, lines[2].ExpressionID)
+		assert.Contains(t, lines[3].Error, "invalid variable")
+	}
+	_, rejected := report(token, job.ID, "?rejected=true")
+	assert.Len(t, rejected, 3)
+	code, _ = report(otherToken, job.ID, "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	computeAll(handler)
+	w := serve(handler, "GET", "/api/v1/expressions/"+strconv.Itoa(lines[0].ExpressionID), "", "Authorization", "Bearer "+token)
+	var expr struct {
+		Expression orch.Expression `json:"expression"`
+	}
+	json.NewDecoder(w.Body).Decode(&expr)
+	assert.Equal(t, "2*x", expr.Expression.Expr)
+	if assert.NotNil(t, expr.Expression.Result) {
+		assert.Equal(t, 8.0, *expr.Expression.Result, "variables are substituted")
+	}
+
+	code, job = upload("history.jsonl", `"5-1"`+"\n"+`{"expression":"a/b","variables":{"a":1,"b":4},"priority":2}`+"\nnot json\n\n"+`{"expression":""}`+"\n")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "jsonl", job.Format)
+	assert.Equal(t, 4, job.Total)
+	assert.Equal(t, 2, job.Accepted)
+	_, rejected = report(token, job.ID, "?rejected=true")
+	if assert.Len(t, rejected, 2) {
+		assert.Equal(t, 3, rejected[0].Line)
+		assert.Equal(t, 5, rejected[1].Line)
+	}
+
+	w = serve(handler, "POST", "/api/v1/expressions/import", `{"expression":"1+1"}`, "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// failingExpressions is a storage that cannot store expressions.
+type failingExpressions struct {
+	database.Storage
+}
+
+func (failingExpressions) CreateExpression(ctx context.Context, userID int, expr string) (*database.Expression, error) {
+	return nil, errors.New("disk full")
+}
+
+func TestImportStorageFailure(t *testing.T) {
+	o := orch.NewOrchestrator()
+	handler := o.Handler()
+	token := userToken(t, o, "importfailure")
+	user, err := o.Database.SelectUser(context.Background(), "importfailure")
+	require.NoError(t, err)
+	o.Database = failingExpressions{o.Database}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "history.csv")
+	part.Write([]byte("2+2\n3*3\n"))
+	mw.Close()
+	w := serve(handler, "POST", "/api/v1/expressions/import", body.String(),
+		"Authorization", "Bearer "+token, "Content-Type", mw.FormDataContentType())
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	job, err := o.Database.GetImportJob(context.Background(), 1, int(user.ID))
+	require.NoError(t, err)
+	assert.Equal(t, "failed", job.Status, "the job does not stay running")
+	assert.Contains(t, job.Error, "disk full")
+	assert.False(t, job.FinishedAt.IsZero())
+}
+
+func TestImportExport(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	from := userToken(t, o, "exportfrom-"+suffix)
+	to := userToken(t, o, "importto-"+suffix)
+
+	expressions := []string{"2*3", "-5+3", "+4", "=2+2", "1/0"}
+	for _, expression := range expressions {
+		serve(handler, "POST", "/api/v1/calculate", `{"expression":"`+expression+`"}`, "Authorization", "Bearer "+from)
+	}
+	computeAll(handler)
+	export := serve(handler, "GET", "/api/v1/expressions/export?format=csv", "", "Authorization", "Bearer "+from)
+	assert.Equal(t, http.StatusOK, export.Code)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "expressions.csv")
+	part.Write(export.Body.Bytes())
+	mw.Close()
+	w := serve(handler, "POST", "/api/v1/expressions/import", body.String(),
+		"Authorization", "Bearer "+to, "Content-Type", mw.FormDataContentType())
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var resp struct {
+		Job database.ImportJob `json:"job"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	assert.Equal(t, len(expressions), resp.Job.Total, "the header is skipped")
+	assert.Equal(t, 1, resp.Job.Rejected, "=2+2 is not an expression")
+	computeAll(handler)
+
+	w = serve(handler, "GET", "/api/v1/expressions/export?format=csv", "", "Authorization", "Bearer "+to)
+	again := csv.NewReader(w.Body)
+	records, err := again.ReadAll()
+	require.NoError(t, err)
+	var imported []string
+	for _, record := range records[1:] {
+		imported = append(imported, record[1])
+	}
+	assert.Equal(t, []string{"2*3", "-5+3", "+4", "1/0"}, imported, "the expressions come back unchanged")
+}
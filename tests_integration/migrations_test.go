@@ -0,0 +1,104 @@
+package tests_integration
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := database.Migrations()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(migrations), 2)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version)
+		assert.NotEmpty(t, m.Name)
+	}
+
+	ctx := context.Background()
+	db, err := database.Connect(tempSQLite(t), database.Options{})
+	require.NoError(t, err)
+	defer db.Close()
+
+	version, err := db.Version(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, version)
+	states, err := db.MigrationStates(ctx)
+	require.NoError(t, err)
+	for _, s := range states {
+		assert.True(t, s.AppliedAt.IsZero(), "migration %d is pending", s.Version)
+	}
+
+	applied, err := db.Migrate(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, applied, 1)
+	applied, err = db.Migrate(ctx, 0)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrations)-1)
+	applied, err = db.Migrate(ctx, 0)
+	require.NoError(t, err)
+	assert.Empty(t, applied, "migrations are applied once")
+	_, err = db.Migrate(ctx, 1)
+	assert.Error(t, err, "migrations cannot be reverted")
+	_, err = db.Migrate(ctx, len(migrations)+1)
+	assert.Error(t, err)
+
+	version, err = db.Version(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+	states, err = db.MigrationStates(ctx)
+	require.NoError(t, err)
+	for _, s := range states {
+		assert.False(t, s.AppliedAt.IsZero(), "migration %d is applied", s.Version)
+	}
+}
+
+// TestLegacyMigration opens a database created before expressions recorded
+// their times and errors and before migrations were versioned.
+func TestLegacyMigration(t *testing.T) {
+	url := tempSQLite(t)
+	legacy, err := sql.Open("sqlite3", strings.TrimPrefix(url, "sqlite://"))
+	require.NoError(t, err)
+	_, err = legacy.Exec(`
+	CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		login TEXT NOT NULL UNIQUE,
+		password TEXT NOT NULL
+	);
+	CREATE TABLE expressions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		expression TEXT NOT NULL,
+		status TEXT NOT NULL,
+		result REAL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	INSERT INTO users (login, password) VALUES ('legacy', 'hash');
+	INSERT INTO expressions (user_id, expression, status, result) VALUES (1, '2+2', 'completed', 4);`)
+	require.NoError(t, err)
+	legacy.Close()
+
+	ctx := context.Background()
+	store, err := database.Open(url, database.Options{})
+	require.NoError(t, err)
+	defer store.Close()
+	e, err := store.GetExpressionByID(ctx, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "2+2", e.Expression)
+	assert.True(t, e.CreatedAt.IsZero())
+	e.Status, e.Error = "error", "ErrDivisionByZero"
+	require.NoError(t, store.UpdateExpression(ctx, e))
+	e, err = store.GetExpressionByID(ctx, 1, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "ErrDivisionByZero", e.Error)
+
+	version, err := store.(*database.DataBase).Version(ctx)
+	require.NoError(t, err)
+	migrations, _ := database.Migrations()
+	assert.Equal(t, len(migrations), version)
+}
@@ -1,10 +1,15 @@
 package tests_integration
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Rail-KH/Final_calc/internal/auth"
 	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
@@ -12,6 +17,11 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+const (
+	testAgentToken    = "test-agent-token"
+	testOperatorToken = "test-operator-token"
+)
+
 func TestConfigFromEnv(t *testing.T) {
 	t.Run("default values", func(t *testing.T) {
 		os.Unsetenv("PORT")
@@ -73,10 +83,11 @@ func TestScheduleTasks(t *testing.T) {
 
 	o.ScheduleTasks(expr)
 
-	assert.Equal(t, 1, len(o.TaskQueue))
-	assert.Equal(t, "*", o.TaskQueue[0].Operation)
-	assert.Equal(t, 3.0, o.TaskQueue[0].Arg1)
-	assert.Equal(t, 4.0, o.TaskQueue[0].Arg2)
+	assert.Equal(t, 1, o.TaskQueue.Len())
+	task := o.TaskQueue.Pop(nil)
+	assert.Equal(t, "*", task.Operation)
+	assert.Equal(t, 3.0, task.Arg1)
+	assert.Equal(t, 4.0, task.Arg2)
 }
 
 func TestAuthMiddleware(t *testing.T) {
@@ -85,8 +96,10 @@ func TestAuthMiddleware(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	}))
 
+	o.Config.AgentTokens = []string{testAgentToken}
+
 	t.Run("allowed paths", func(t *testing.T) {
-		paths := []string{"/api/v1/login", "/api/v1/register", "/internal/task"}
+		paths := []string{"/api/v1/login", "/api/v1/register"}
 		for _, path := range paths {
 			req := httptest.NewRequest("GET", path, nil)
 			w := httptest.NewRecorder()
@@ -96,6 +109,22 @@ func TestAuthMiddleware(t *testing.T) {
 		}
 	})
 
+	t.Run("agent token", func(t *testing.T) {
+		tokens := map[string]int{
+			"":             http.StatusUnauthorized,
+			"wrong-token":  http.StatusUnauthorized,
+			testAgentToken: http.StatusOK,
+		}
+		for token, code := range tokens {
+			req := httptest.NewRequest("GET", "/internal/task", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, code, w.Code, "token: %q", token)
+		}
+	})
+
 	t.Run("unauthorized request", func(t *testing.T) {
 		req := httptest.NewRequest("GET", "/api/v1/expressions", nil)
 		w := httptest.NewRecorder()
@@ -105,8 +134,8 @@ func TestAuthMiddleware(t *testing.T) {
 	})
 
 	t.Run("authorized request", func(t *testing.T) {
-		o.Database.InsertUser("middlewareuser", "middlewarepass")
-		user, _ := o.Database.SelectUser("middlewareuser")
+		o.Database.InsertUser(context.Background(), "middlewareuser", "middlewarepass")
+		user, _ := o.Database.SelectUser(context.Background(), "middlewareuser")
 		token, _ := auth.GenJWT(int(user.ID))
 
 		req := httptest.NewRequest("GET", "/api/v1/expressions", nil)
@@ -117,3 +146,134 @@ func TestAuthMiddleware(t *testing.T) {
 		assert.Equal(t, http.StatusOK, w.Code)
 	})
 }
+
+func TestGetTaskLongPolling(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/calculate" {
+			o.CalculateHandler(w, r)
+			return
+		}
+		o.GetTaskHandler(w, r)
+	}))
+
+	t.Run("timeout without tasks", func(t *testing.T) {
+		start := time.Now()
+		req := httptest.NewRequest("GET", "/internal/task?wait=200ms", nil)
+		req.Header.Set("Authorization", "Bearer "+testAgentToken)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	})
+
+	t.Run("invalid wait", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/internal/task?wait=soon", nil)
+		req.Header.Set("Authorization", "Bearer "+testAgentToken)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("wakes up on new task", func(t *testing.T) {
+		o.Database.InsertUser(context.Background(), "pollinguser", "pollingpass")
+		user, _ := o.Database.SelectUser(context.Background(), "pollinguser")
+		token, _ := auth.GenJWT(int(user.ID))
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			req := httptest.NewRequest("POST", "/api/v1/calculate", strings.NewReader(`{"expression":"6*7"}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+
+		req := httptest.NewRequest("GET", "/internal/task?wait=5", nil)
+		req.Header.Set("Authorization", "Bearer "+testAgentToken)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"operation":"*"`)
+	})
+}
+
+func TestBatchTasks(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v1/calculate":
+			o.CalculateHandler(w, r)
+		case r.Method == http.MethodGet:
+			o.GetTaskHandler(w, r)
+		default:
+			o.PostTaskHandler(w, r)
+		}
+	}))
+	o.Database.InsertUser(context.Background(), "batchuser", "batchpass")
+	user, _ := o.Database.SelectUser(context.Background(), "batchuser")
+	token, _ := auth.GenJWT(int(user.ID))
+
+	req := httptest.NewRequest("POST", "/api/v1/calculate", strings.NewReader(`{"expression":"(1+2)*(3+4)"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	fetch := func() []orch.Task {
+		req := httptest.NewRequest("GET", "/internal/task?max=10", nil)
+		req.Header.Set("Authorization", "Bearer "+testAgentToken)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var resp struct {
+			Tasks []orch.Task `json:"tasks"`
+		}
+		if w.Code == http.StatusOK {
+			json.NewDecoder(w.Body).Decode(&resp)
+		}
+		return resp.Tasks
+	}
+
+	tasks := fetch()
+	assert.Equal(t, 2, len(tasks))
+	assert.Empty(t, fetch(), "leased tasks must not be handed out twice")
+
+	body := fmt.Sprintf(`{"results":[{"id":%q,"result":3},{"id":%q,"result":7},{"id":"missing","result":0}]}`, tasks[0].ID, tasks[1].ID)
+	req = httptest.NewRequest("POST", "/internal/task", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAgentToken)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `{"id":"missing","status":"task not found"}`)
+
+	tasks = fetch()
+	assert.Equal(t, 1, len(tasks))
+	assert.Equal(t, "*", tasks[0].Operation)
+	assert.Equal(t, 3.0, tasks[0].Arg1)
+	assert.Equal(t, 7.0, tasks[0].Arg2)
+
+	// A failed task ends its expression, so its other tasks are dropped.
+	req = httptest.NewRequest("POST", "/api/v1/calculate", strings.NewReader(`{"expression":"(8/0)+(9*9)"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	req = httptest.NewRequest("GET", "/internal/task?max=1", nil)
+	req.Header.Set("Authorization", "Bearer "+testAgentToken)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	var resp struct {
+		Tasks []orch.Task `json:"tasks"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	assert.Len(t, resp.Tasks, 1)
+	req = httptest.NewRequest("POST", "/internal/task", strings.NewReader(fmt.Sprintf(`{"id":%q,"error":"division by zero"}`, resp.Tasks[0].ID)))
+	req.Header.Set("Authorization", "Bearer "+testAgentToken)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, fetch(), "tasks of a failed expression are not handed out")
+}
@@ -0,0 +1,169 @@
+package tests_integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/agent"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+// computeAll plays an agent until the queue is empty.
+func computeAll(handler http.Handler) {
+	for {
+		w := serve(handler, "GET", "/internal/task", "", "Authorization", "Bearer "+testAgentToken)
+		if w.Code != http.StatusOK {
+			return
+		}
+		var resp struct {
+			Task orch.Task `json:"task"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		var body string
+		if result, err := agent.Calc(resp.Task.Operation, resp.Task.Arg1, resp.Task.Arg2); err != nil {
+			body = fmt.Sprintf(`{"id":"%s","error":%q}`, resp.Task.ID, err.Error())
+		} else {
+			body = fmt.Sprintf(`{"id":"%s","result":%v}`, resp.Task.ID, result)
+		}
+		serve(handler, "POST", "/internal/task", body, "Authorization", "Bearer "+testAgentToken)
+	}
+}
+
+func TestDeleteExpressions(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	token := userToken(t, o, "deleteuser-"+suffix)
+	otherToken := userToken(t, o, "deleteother-"+suffix)
+
+	submit := func(expression string) string {
+		w := serve(handler, "POST", "/api/v1/calculate", `{"expression":"`+expression+`"}`, "Authorization", "Bearer "+token)
+		var resp struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.ID
+	}
+	del := func(token, path string) *httptest.ResponseRecorder {
+		return serve(handler, "DELETE", path, "", "Authorization", "Bearer "+token)
+	}
+
+	submit("2+2")
+	submit("5-1")
+	submit("8/0")
+	computeAll(handler)
+	running := submit("3*3")
+	assert.Equal(t, 1, o.TaskQueue.Len())
+
+	assert.Equal(t, http.StatusNotFound, del(otherToken, "/api/v1/expressions/"+running).Code)
+	assert.Equal(t, http.StatusNoContent, del(token, "/api/v1/expressions/"+running).Code)
+	assert.Equal(t, 0, o.TaskQueue.Len(), "a running expression is cancelled")
+	assert.Equal(t, http.StatusNotFound, serve(handler, "GET", "/api/v1/expressions/"+running, "", "Authorization", "Bearer "+token).Code)
+	assert.Equal(t, http.StatusNotFound, del(token, "/api/v1/expressions/"+running).Code)
+
+	assert.Equal(t, http.StatusBadRequest, del(token, "/api/v1/expressions").Code, "a filter is required")
+	deleted := func(w *httptest.ResponseRecorder) int {
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp struct {
+			Deleted int `json:"deleted"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Deleted
+	}
+	assert.Equal(t, 0, deleted(del(otherToken, "/api/v1/expressions?q=%2B")))
+	assert.Equal(t, 1, deleted(del(token, "/api/v1/expressions?q=%2B")))
+	assert.Equal(t, 1, deleted(del(token, "/api/v1/expressions?status=error")))
+	assert.Equal(t, 1, deleted(del(token, "/api/v1/expressions?to="+time.Now().Add(time.Minute).UTC().Format(time.RFC3339))))
+	assert.Equal(t, 0, deleted(del(token, "/api/v1/expressions?status=completed")))
+}
+
+func TestRetention(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "retentionuser-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	submit := func(expression string) {
+		serve(handler, "POST", "/api/v1/calculate", `{"expression":"`+expression+`"}`, "Authorization", "Bearer "+token)
+	}
+	list := func() []string {
+		var resp struct {
+			Expressions []orch.Expression `json:"expressions"`
+		}
+		w := serve(handler, "GET", "/api/v1/expressions", "", "Authorization", "Bearer "+token)
+		json.NewDecoder(w.Body).Decode(&resp)
+		var exprs []string
+		for _, e := range resp.Expressions {
+			exprs = append(exprs, e.Expr)
+		}
+		return exprs
+	}
+
+	for _, expression := range []string{"1+1", "2+2", "3+3", "4+4"} {
+		submit(expression)
+	}
+	computeAll(handler)
+	submit("5+5")
+
+	o.Config.RetentionMaxCount = 3
+	_, err := o.ApplyRetention(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3+3", "4+4", "5+5"}, list(), "the running expression counts but is kept")
+
+	o.Config.RetentionMaxCount = 0
+	o.Config.RetentionMaxAge = 60 * 1000
+	_, err = o.ApplyRetention(time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, list(), 3)
+	_, err = o.ApplyRetention(time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"5+5"}, list(), "only finished expressions are removed")
+}
+
+func TestUserRetention(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	token := userToken(t, o, "userretention-"+suffix)
+	otherToken := userToken(t, o, "userretentionother-"+suffix)
+	retention := func(method, body string) *httptest.ResponseRecorder {
+		return serve(handler, method, "/api/v1/retention", body, "Authorization", "Bearer "+token)
+	}
+	count := func(token string) int {
+		var resp struct {
+			Expressions []orch.Expression `json:"expressions"`
+		}
+		w := serve(handler, "GET", "/api/v1/expressions", "", "Authorization", "Bearer "+token)
+		json.NewDecoder(w.Body).Decode(&resp)
+		return len(resp.Expressions)
+	}
+
+	w := retention("GET", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"max_age_ms":null,"max_count":null}`, w.Body.String())
+	assert.Equal(t, http.StatusUnprocessableEntity, retention("PUT", `{"max_count":-1}`).Code)
+	w = retention("PUT", `{"max_count":1}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"max_age_ms":null,"max_count":1}`, retention("GET", "").Body.String())
+
+	for _, tok := range []string{token, token, otherToken, otherToken} {
+		serve(handler, "POST", "/api/v1/calculate", `{"expression":"2+2"}`, "Authorization", "Bearer "+tok)
+	}
+	computeAll(handler)
+	_, err := o.ApplyRetention(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count(token), "the user overrides the global policy")
+	assert.Equal(t, 2, count(otherToken), "the global policy keeps everything")
+
+	assert.Equal(t, http.StatusNoContent, retention("DELETE", "").Code)
+	assert.JSONEq(t, `{"max_age_ms":null,"max_count":null}`, retention("GET", "").Body.String())
+	assert.Equal(t, http.StatusMethodNotAllowed, retention("POST", "").Code)
+}
@@ -0,0 +1,200 @@
+package tests_integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"testing"
+
+	"github.com/Rail-KH/Final_calc/internal/agent"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFairScheduler(t *testing.T) {
+	s := orch.NewFairScheduler()
+	for _, id := range []string{"big0", "big1", "big2"} {
+		s.Push(&orch.Task{ID: id, UserID: "1"})
+	}
+	s.Push(&orch.Task{ID: "small", UserID: "2"})
+	s.Push(&orch.Task{ID: "urgent", UserID: "1", Priority: 5})
+
+	assert.Equal(t, 5, s.Len())
+	assert.Equal(t, map[string]int{"1": 4, "2": 1}, s.Depth())
+
+	var order []string
+	for task := s.Pop(nil); task != nil; task = s.Pop(nil) {
+		order = append(order, task.ID)
+	}
+	assert.Equal(t, []string{"urgent", "small", "big0", "big1", "big2"}, order)
+	assert.Equal(t, 0, s.Len())
+
+	first, second := &orch.Task{ID: "a", UserID: "1"}, &orch.Task{ID: "b", UserID: "1"}
+	s.Push(first)
+	s.Push(second)
+	s.Requeue(s.Pop(func(t *orch.Task) bool { return t.ID == "b" }))
+	assert.Equal(t, "b", s.Pop(nil).ID, "requeued tasks go first")
+	s.Remove(first)
+	assert.Nil(t, s.Pop(nil))
+}
+
+func TestFIFOScheduler(t *testing.T) {
+	s := orch.NewFIFOScheduler()
+	s.Push(&orch.Task{ID: "1", UserID: "1"})
+	s.Push(&orch.Task{ID: "2", UserID: "1"})
+	s.Push(&orch.Task{ID: "3", UserID: "2"})
+	s.Push(&orch.Task{ID: "4", UserID: "2", Priority: 1})
+
+	var order []string
+	for task := s.Pop(nil); task != nil; task = s.Pop(nil) {
+		order = append(order, task.ID)
+	}
+	assert.Equal(t, []string{"4", "1", "2", "3"}, order)
+
+	_, err := orch.NewScheduler("lottery")
+	assert.Error(t, err)
+}
+
+func TestQueueDepth(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "queueuser")
+
+	w := serve(handler, "POST", "/api/v1/calculate", `{"expression":"1+2+3*4","priority":3}`, "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = serve(handler, "GET", "/internal/queue", "", "Authorization", "Bearer "+testAgentToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Scheduler string         `json:"scheduler"`
+		Total     int            `json:"total"`
+		Users     map[string]int `json:"users"`
+	}
+	json.NewDecoder(w.Body).Decode(&resp)
+	assert.Equal(t, "fair", resp.Scheduler)
+	assert.Equal(t, 2, resp.Total)
+	assert.Len(t, resp.Users, 1)
+	for _, depth := range resp.Users {
+		assert.Equal(t, 2, depth)
+	}
+}
+
+func TestPriorityRange(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "priorityuser")
+
+	// Priorities beyond the range are clamped, so the first expression is
+	// not overtaken.
+	for _, body := range []string{`{"expression":"1+1","priority":100}`, `{"expression":"2*2","priority":1000000}`} {
+		assert.Equal(t, http.StatusCreated, serve(handler, "POST", "/api/v1/calculate", body, "Authorization", "Bearer "+token).Code)
+	}
+	var fetched struct {
+		Task orch.Task `json:"task"`
+	}
+	json.NewDecoder(serve(handler, "GET", "/internal/task", "", "Authorization", "Bearer "+testAgentToken).Body).Decode(&fetched)
+	assert.Equal(t, "+", fetched.Task.Operation)
+}
+
+// unbalancedExpression is a balanced tree of 2^depth multiplications next to
+// a chain of chain multiplications, which is the critical path.
+func unbalancedExpression(depth, chain int) string {
+	var wide func(depth int) string
+	wide = func(depth int) string {
+		if depth == 0 {
+			return "1*1"
+		}
+		return "(" + wide(depth-1) + "+" + wide(depth-1) + ")"
+	}
+	expr := "2"
+	for i := 0; i < chain; i++ {
+		expr = "(" + expr + "*2)"
+	}
+	return wide(depth) + "+" + expr
+}
+
+// simulateMakespan evaluates the expression with the given number of workers
+// in simulated time and returns the milliseconds until the last task is done.
+func simulateMakespan(t testing.TB, handler http.Handler, token string, workers int, expression string) int {
+	t.Helper()
+	w := serve(handler, "POST", "/api/v1/calculate", `{"expression":"`+expression+`"}`, "Authorization", "Bearer "+token)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("calculate: %d %s", w.Code, w.Body)
+	}
+	type running struct {
+		task orch.Task
+		done int
+	}
+	var busy []running
+	now := 0
+	for {
+		for len(busy) < workers {
+			w := serve(handler, "GET", "/internal/task", "", "Authorization", "Bearer "+testAgentToken)
+			if w.Code != http.StatusOK {
+				break
+			}
+			var resp struct {
+				Task orch.Task `json:"task"`
+			}
+			json.NewDecoder(w.Body).Decode(&resp)
+			busy = append(busy, running{resp.Task, now + resp.Task.OperationTime})
+		}
+		if len(busy) == 0 {
+			return now
+		}
+		sort.Slice(busy, func(i, j int) bool { return busy[i].done < busy[j].done })
+		next := busy[0]
+		busy = busy[1:]
+		now = next.done
+		result, _ := agent.Calc(next.task.Operation, next.task.Arg1, next.task.Arg2)
+		body := fmt.Sprintf(`{"id":"%s","result":%v}`, next.task.ID, result)
+		serve(handler, "POST", "/internal/task", body, "Authorization", "Bearer "+testAgentToken)
+	}
+}
+
+func TestCriticalPathScheduling(t *testing.T) {
+	// The same expression is evaluated twice; the second run must not be
+	// answered from the result cache or the task memo table.
+	t.Setenv("RESULT_CACHE_SIZE", "0")
+	t.Setenv("TASK_MEMO_SIZE", "0")
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "scheduleruser")
+	expression := unbalancedExpression(4, 12)
+
+	o.TaskQueue = orch.NewFIFOScheduler()
+	fifo := simulateMakespan(t, handler, token, 2, expression)
+	o.TaskQueue = orch.NewCriticalPathScheduler()
+	criticalPath := simulateMakespan(t, handler, token, 2, expression)
+
+	assert.Less(t, criticalPath, fifo)
+}
+
+func BenchmarkSchedulers(b *testing.B) {
+	b.Setenv("RESULT_CACHE_SIZE", "0")
+	b.Setenv("TASK_MEMO_SIZE", "0")
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(b, o, "scheduleruser")
+	expression := unbalancedExpression(4, 12)
+
+	for _, policy := range []string{"fifo", "critical-path"} {
+		b.Run(policy, func(b *testing.B) {
+			scheduler, err := orch.NewScheduler(policy)
+			if err != nil {
+				b.Fatal(err)
+			}
+			o.TaskQueue = scheduler
+			makespan := 0
+			for i := 0; i < b.N; i++ {
+				makespan = simulateMakespan(b, handler, token, 2, expression)
+			}
+			b.ReportMetric(float64(makespan), "sim-ms")
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package tests_integration
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Rail-KH/Final_calc/internal/database"
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStorage runs the same checks against every storage. PostgreSQL is
+// checked when TEST_POSTGRES_URL points to a database that may be written to.
+func TestStorage(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testStorage(t, database.NewMemory())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := database.Open(tempSQLite(t), database.Options{})
+		require.NoError(t, err)
+		defer store.Close()
+		testStorage(t, store)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		url := os.Getenv("TEST_POSTGRES_URL")
+		if url == "" {
+			t.Skip("TEST_POSTGRES_URL is not set")
+		}
+		store, err := database.Open(url, database.Options{})
+		require.NoError(t, err)
+		defer store.Close()
+		testStorage(t, store)
+	})
+}
+
+func TestOpenStorage(t *testing.T) {
+	_, err := database.Open("mysql://localhost/calc", database.Options{})
+	assert.Error(t, err)
+	_, err = database.Open("sqlite://", database.Options{})
+	assert.Error(t, err)
+	store, err := database.Open("memory://", database.Options{})
+	assert.NoError(t, err)
+	assert.IsType(t, &database.Memory{}, store)
+}
+
+func testStorage(t *testing.T, store database.Storage) {
+	ctx := context.Background()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	newUser := func(login string) int {
+		id, err := store.InsertUser(ctx, login+"-"+suffix, "pass")
+		require.NoError(t, err)
+		return int(id)
+	}
+	userID, otherID := newUser("storage"), newUser("storageother")
+
+	t.Run("users", func(t *testing.T) {
+		_, err := store.InsertUser(ctx, "storage-"+suffix, "pass")
+		assert.ErrorIs(t, err, database.ErrDuplicateLogin)
+		user, err := store.SelectUser(ctx, "storage-"+suffix)
+		require.NoError(t, err)
+		assert.Equal(t, int64(userID), user.ID)
+		assert.NotEqual(t, "pass", user.Password, "passwords are hashed")
+		_, err = store.SelectUser(ctx, "missing-"+suffix)
+		assert.ErrorIs(t, err, database.ErrNotFound)
+
+		// No user has an ID this large in any of the test databases.
+		const unknownID = 1 << 30
+		_, err = store.CreateExpression(ctx, unknownID, "2+2")
+		assert.ErrorIs(t, err, database.ErrUnknownUser)
+		_, _, err = store.CreateBatch(ctx, unknownID, []string{"2+2"})
+		assert.ErrorIs(t, err, database.ErrUnknownUser)
+		assert.ErrorIs(t, store.SetWebhook(ctx, unknownID, "http://example.com/hook"), database.ErrUnknownUser)
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = store.CreateExpression(cancelled, userID, "2+2")
+		assert.ErrorIs(t, err, context.Canceled)
+		_, err = store.SelectUser(cancelled, "storage-"+suffix)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	create := func(expr, status string, result *float64) *database.Expression {
+		e, err := store.CreateExpression(ctx, userID, expr)
+		require.NoError(t, err)
+		assert.Equal(t, "pending", e.Status)
+		assert.False(t, e.CreatedAt.IsZero())
+		e.Status, e.Result = status, result
+		if status == "error" {
+			e.Error = "ErrDivisionByZero"
+		}
+		require.NoError(t, store.UpdateExpression(ctx, e))
+		return e
+	}
+	six := 6.0
+	done := create("2*3", "completed", &six)
+	running := create("X*2", "completed", nil)
+	failed := create("1/0", "error", nil)
+
+	t.Run("expressions", func(t *testing.T) {
+		e, err := store.GetExpressionByID(ctx, done.ID, userID)
+		require.NoError(t, err)
+		assert.Equal(t, "2*3", e.Expression)
+		if assert.NotNil(t, e.Result) {
+			assert.Equal(t, 6.0, *e.Result)
+		}
+		e, err = store.GetExpressionByID(ctx, failed.ID, userID)
+		require.NoError(t, err)
+		assert.Equal(t, "ErrDivisionByZero", e.Error)
+		_, err = store.GetExpressionByID(ctx, done.ID, otherID)
+		assert.ErrorIs(t, err, database.ErrNotFound)
+
+		page, err := store.ListExpressions(ctx, userID, database.ExpressionQuery{
+			ExpressionFilter: database.ExpressionFilter{Statuses: []string{"pending"}},
+			Limit:            10,
+		})
+		require.NoError(t, err)
+		if assert.Len(t, page.Expressions, 1) {
+			assert.Equal(t, running.ID, page.Expressions[0].ID, "running expressions are listed as pending")
+		}
+		page, err = store.ListExpressions(ctx, userID, database.ExpressionQuery{
+			ExpressionFilter: database.ExpressionFilter{Search: "x"},
+			Limit:            10,
+		})
+		require.NoError(t, err)
+		assert.Len(t, page.Expressions, 1, "search ignores case")
+
+		// status desc: pending, error, completed
+		var ids []int
+		q := database.ExpressionQuery{Sort: "status", Desc: true, Limit: 1}
+		for {
+			page, err := store.ListExpressions(ctx, userID, q)
+			require.NoError(t, err)
+			for _, e := range page.Expressions {
+				ids = append(ids, e.ID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			q.Cursor = page.NextCursor
+		}
+		assert.Equal(t, []int{running.ID, failed.ID, done.ID}, ids)
+
+		var exported []string
+		err = store.ExportExpressions(ctx, userID, database.ExpressionFilter{}, func(e *database.Expression) error {
+			exported = append(exported, e.Expression)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"2*3", "X*2", "1/0"}, exported)
+	})
+
+	t.Run("batches", func(t *testing.T) {
+		id, ids, err := store.CreateBatch(ctx, userID, []string{"1+1", "2+2"})
+		require.NoError(t, err)
+		exprs, err := store.GetBatch(ctx, id, userID)
+		require.NoError(t, err)
+		if assert.Len(t, exprs, 2) {
+			assert.Equal(t, ids, []int{exprs[0].ID, exprs[1].ID})
+			assert.Equal(t, "2+2", exprs[1].Expression)
+		}
+		_, err = store.GetBatch(ctx, id, otherID)
+		assert.ErrorIs(t, err, database.ErrNotFound)
+	})
+
+	t.Run("idempotency", func(t *testing.T) {
+		now := time.Now()
+		reserve := func(hash string, at time.Time) (*database.IdempotentResponse, error) {
+			return store.ReserveIdempotencyKey(ctx, userID, "key", hash, at, at.Add(-time.Hour), at.Add(-time.Minute))
+		}
+		stored, err := reserve("hash", now)
+		require.NoError(t, err)
+		assert.Nil(t, stored)
+		stored, err = reserve("other", now)
+		require.NoError(t, err)
+		if assert.NotNil(t, stored) {
+			assert.Equal(t, "hash", stored.RequestHash)
+			assert.Zero(t, stored.StatusCode)
+		}
+		require.NoError(t, store.SaveIdempotentResponse(ctx, userID, "key", now, 201, `{"id":"1"}`))
+		stored, err = reserve("hash", now)
+		require.NoError(t, err)
+		if assert.NotNil(t, stored) {
+			assert.Equal(t, 201, stored.StatusCode)
+			assert.Equal(t, `{"id":"1"}`, stored.Body)
+		}
+		stored, err = reserve("hash", now.Add(2*time.Minute))
+		require.NoError(t, err)
+		assert.NotNil(t, stored, "finished requests are kept for the TTL")
+		require.NoError(t, store.DeleteIdempotencyKey(ctx, userID, "key", now))
+		stored, err = reserve("hash", now)
+		require.NoError(t, err)
+		assert.Nil(t, stored)
+
+		// A reservation left in progress is taken over after its lease, and
+		// the abandoned request can no longer complete or release it.
+		later := now.Add(2 * time.Minute)
+		stored, err = reserve("hash", later)
+		require.NoError(t, err)
+		assert.Nil(t, stored)
+		require.NoError(t, store.SaveIdempotentResponse(ctx, userID, "key", now, 500, "stale"))
+		require.NoError(t, store.DeleteIdempotencyKey(ctx, userID, "key", now))
+		stored, err = reserve("hash", later)
+		require.NoError(t, err)
+		if assert.NotNil(t, stored) {
+			assert.Zero(t, stored.StatusCode)
+		}
+		require.NoError(t, store.DeleteIdempotencyKey(ctx, userID, "key", later))
+	})
+
+	t.Run("webhooks", func(t *testing.T) {
+		require.NoError(t, store.SetWebhook(ctx, userID, "http://a.example"))
+		require.NoError(t, store.SetWebhook(ctx, userID, "http://b.example"))
+		url, err := store.GetWebhook(ctx, userID)
+		require.NoError(t, err)
+		assert.Equal(t, "http://b.example", url)
+		require.NoError(t, store.SetWebhook(ctx, userID, ""))
+		url, err = store.GetWebhook(ctx, userID)
+		require.NoError(t, err)
+		assert.Empty(t, url)
+
+		now := time.Now()
+		newDelivery := func(next time.Time) *database.Delivery {
+			dl := &database.Delivery{UserID: userID, ExpressionID: done.ID, URL: "http://a.example", Payload: "{}",
+				Status: "pending", NextAttempt: next, CreatedAt: now, UpdatedAt: now}
+			require.NoError(t, store.CreateDelivery(ctx, dl))
+			return dl
+		}
+		late := newDelivery(now.Add(-time.Second))
+		early := newDelivery(now.Add(-time.Minute))
+		newDelivery(now.Add(time.Hour))
+
+		due, err := store.DueDeliveries(ctx, now, 100)
+		require.NoError(t, err)
+		var dueIDs []int
+		for _, dl := range due {
+			dueIDs = append(dueIDs, dl.ID)
+		}
+		assert.Contains(t, dueIDs, late.ID)
+		assert.Contains(t, dueIDs, early.ID)
+
+		early.Status, early.Attempts, early.ResponseCode = "delivered", 1, 200
+		require.NoError(t, store.UpdateDelivery(ctx, early))
+		log, err := store.GetDeliveries(ctx, userID, 10)
+		require.NoError(t, err)
+		if assert.Len(t, log, 3) {
+			assert.Equal(t, early.ID, log[1].ID, "newest first")
+			assert.Equal(t, "delivered", log[1].Status)
+			assert.Equal(t, 200, log[1].ResponseCode)
+		}
+	})
+
+	t.Run("imports", func(t *testing.T) {
+		job := &database.ImportJob{UserID: userID, Filename: "a.csv", Format: "csv", Status: "running", CreatedAt: time.Now()}
+		require.NoError(t, store.CreateImportJob(ctx, job))
+		require.NoError(t, store.AddImportLines(ctx, job.ID, []database.ImportLine{
+			{Line: 2, ExpressionID: done.ID},
+			{Line: 1, Error: "empty expression"},
+		}))
+		job.Status, job.Total, job.Accepted, job.Rejected, job.FinishedAt = "completed", 2, 1, 1, time.Now()
+		require.NoError(t, store.UpdateImportJob(ctx, job))
+
+		stored, err := store.GetImportJob(ctx, job.ID, userID)
+		require.NoError(t, err)
+		assert.Equal(t, "completed", stored.Status)
+		assert.Equal(t, 2, stored.Total)
+		assert.False(t, stored.FinishedAt.IsZero())
+		_, err = store.GetImportJob(ctx, job.ID, otherID)
+		assert.ErrorIs(t, err, database.ErrNotFound)
+
+		lines, err := store.GetImportLines(ctx, job.ID, false)
+		require.NoError(t, err)
+		assert.Equal(t, []database.ImportLine{{Line: 1, Error: "empty expression"}, {Line: 2, ExpressionID: done.ID}}, lines)
+		lines, err = store.GetImportLines(ctx, job.ID, true)
+		require.NoError(t, err)
+		assert.Len(t, lines, 1)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ids, err := store.DeleteExpressions(ctx, userID, database.ExpressionFilter{Statuses: []string{"error", "pending"}})
+		require.NoError(t, err)
+		assert.Equal(t, []int{failed.ID}, ids, "running expressions are kept")
+
+		assert.NoError(t, store.DeleteExpression(ctx, done.ID, userID))
+		assert.ErrorIs(t, store.DeleteExpression(ctx, done.ID, userID), database.ErrNotFound)
+		log, err := store.GetDeliveries(ctx, userID, 10)
+		require.NoError(t, err)
+		assert.Empty(t, log, "deliveries of deleted expressions are removed")
+
+		old := create("3-1", "completed", &six)
+		purged, err := store.PurgeExpressions(ctx, time.Now(), 0, 1)
+		require.NoError(t, err)
+		assert.NotContains(t, purged, old.ID, "the newest expression is kept")
+		assert.NotContains(t, purged, running.ID, "running expressions are kept")
+		newest := create("3-2", "completed", &six)
+		purged, err = store.PurgeExpressions(ctx, time.Now().Add(time.Minute), time.Second, 0)
+		require.NoError(t, err)
+		assert.Contains(t, purged, old.ID)
+		assert.Contains(t, purged, newest.ID)
+		_, err = store.GetExpressionByID(ctx, running.ID, userID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		retention, err := store.GetRetention(ctx, otherID)
+		require.NoError(t, err)
+		assert.Equal(t, database.Retention{}, retention)
+		_, err = store.GetRetention(ctx, 1<<30)
+		assert.ErrorIs(t, err, database.ErrUnknownUser)
+		assert.ErrorIs(t, store.SetRetention(ctx, 1<<30, database.Retention{}), database.ErrUnknownUser)
+
+		one, zero := 1, 0
+		require.NoError(t, store.SetRetention(ctx, otherID, database.Retention{MaxCount: &one}))
+		retention, err = store.GetRetention(ctx, otherID)
+		require.NoError(t, err)
+		assert.Nil(t, retention.MaxAge)
+		if assert.NotNil(t, retention.MaxCount) {
+			assert.Equal(t, 1, *retention.MaxCount)
+		}
+
+		finishedFor := func(userID int) int {
+			e, err := store.CreateExpression(ctx, userID, "1+1")
+			require.NoError(t, err)
+			e.Status, e.Result = "completed", &six
+			require.NoError(t, store.UpdateExpression(ctx, e))
+			return e.ID
+		}
+		older, newer, own := finishedFor(otherID), finishedFor(otherID), finishedFor(userID)
+		purged, err := store.PurgeExpressions(ctx, time.Now(), 0, 0)
+		require.NoError(t, err)
+		assert.Contains(t, purged, older, "the user keeps one expression")
+		assert.NotContains(t, purged, newer)
+		assert.NotContains(t, purged, own, "other users follow the global policy")
+
+		require.NoError(t, store.SetRetention(ctx, otherID, database.Retention{MaxAge: &zero, MaxCount: &zero}))
+		purged, err = store.PurgeExpressions(ctx, time.Now().Add(time.Minute), time.Second, 1)
+		require.NoError(t, err)
+		assert.NotContains(t, purged, newer, "zero disables the global limits")
+		assert.Contains(t, purged, own)
+	})
+}
+
+func TestSQLiteOptions(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.Connect(tempSQLite(t), database.Options{MaxOpenConns: 2})
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Migrate(ctx, 0)
+	require.NoError(t, err)
+
+	var journal string
+	var foreignKeys, busyTimeout int
+	require.NoError(t, db.DB.QueryRow(`PRAGMA journal_mode`).Scan(&journal))
+	require.NoError(t, db.DB.QueryRow(`PRAGMA foreign_keys`).Scan(&foreignKeys))
+	require.NoError(t, db.DB.QueryRow(`PRAGMA busy_timeout`).Scan(&busyTimeout))
+	assert.Equal(t, "wal", journal)
+	assert.Equal(t, 1, foreignKeys)
+	assert.Equal(t, 5000, busyTimeout)
+	assert.Equal(t, 2, db.DB.Stats().MaxOpenConnections)
+
+	_, err = db.CreateExpression(ctx, 12345, "2+2")
+	assert.ErrorIs(t, err, database.ErrUnknownUser, "expressions of unknown users are rejected")
+
+	db, err = database.Connect(tempSQLite(t)+"?_busy_timeout=100", database.Options{})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.DB.QueryRow(`PRAGMA busy_timeout`).Scan(&busyTimeout))
+	assert.Equal(t, 100, busyTimeout, "the URL overrides the defaults")
+}
+
+func TestQueryTimeout(t *testing.T) {
+	url := tempSQLite(t)
+	db, err := database.Connect(url, database.Options{QueryTimeout: time.Nanosecond})
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Migrate(context.Background(), 0)
+	require.NoError(t, err, "migrations are not limited by the query timeout")
+	_, err = db.SelectUser(context.Background(), "timeout")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	t.Setenv("DATABASE_URL", url)
+	o := orch.NewOrchestrator()
+	defer o.Database.Close()
+	handler := o.Handler()
+	token := userToken(t, o, "timeoutuser")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/api/v1/expressions", nil).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "a cancelled request")
+
+	o.Database = db
+	w = serve(handler, "GET", "/api/v1/expressions", "", "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code, "a query out of time")
+	w = serve(handler, "POST", "/api/v1/calculate", `{"expression":"2+2"}`, "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+}
+
+// slowStorage blocks writes of expressions until release is closed.
+type slowStorage struct {
+	database.Storage
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStorage) UpdateExpression(ctx context.Context, e *database.Expression) error {
+	s.blocked <- struct{}{}
+	<-s.release
+	return s.Storage.UpdateExpression(ctx, e)
+}
+
+// TestSlowStorage checks that a slow write of a finished expression does not
+// hold up the orchestrator.
+func TestSlowStorage(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "slowuser-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	serve(handler, "POST", "/api/v1/calculate", `{"expression":"2+2"}`, "Authorization", "Bearer "+token)
+
+	slow := &slowStorage{Storage: o.Database, blocked: make(chan struct{}), release: make(chan struct{})}
+	o.Database = slow
+	done := make(chan struct{})
+	go func() {
+		computeAll(handler)
+		close(done)
+	}()
+	select {
+	case <-slow.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the expression was not saved")
+	}
+
+	queued := make(chan int)
+	go func() {
+		queued <- serve(handler, "GET", "/internal/queue", "", "Authorization", "Bearer "+testAgentToken).Code
+	}()
+	select {
+	case code := <-queued:
+		assert.Equal(t, http.StatusOK, code)
+	case <-time.After(5 * time.Second):
+		t.Error("the orchestrator waits for the database")
+	}
+	close(slow.release)
+	<-done
+}
@@ -0,0 +1,119 @@
+package tests_integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultVerification(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	o.Config.OperatorTokens = []string{testOperatorToken}
+	handler := o.Handler()
+	token := userToken(t, o, "verifyuser")
+
+	agent := agentClient(handler)
+	for _, id := range []string{"honest-1", "honest-2", "liar"} {
+		assert.Equal(t, http.StatusCreated, agent("POST", "/internal/agents", `{"id":"`+id+`"}`, id).Code)
+	}
+	fetch := func(agentID string) []orch.Task {
+		var resp struct {
+			Tasks []orch.Task `json:"tasks"`
+		}
+		json.NewDecoder(agent("GET", "/internal/task?max=5", "", agentID).Body).Decode(&resp)
+		return resp.Tasks
+	}
+	submit := func(agentID, taskID string, result float64) string {
+		w := agent("POST", "/internal/task", `{"results":[{"id":"`+taskID+`","result":`+strconv.FormatFloat(result, 'g', -1, 64)+`}]}`, agentID)
+		var resp struct {
+			Results []struct {
+				Status string `json:"status"`
+			} `json:"results"`
+		}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Results[0].Status
+	}
+
+	w := serve(handler, "POST", "/api/v1/calculate", `{"expression":"2*3","replicas":2}`, "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		ID string `json:"id"`
+	}
+	json.NewDecoder(w.Body).Decode(&created)
+
+	first := fetch("honest-1")
+	assert.Len(t, first, 1)
+	assert.Empty(t, fetch("honest-1"), "the same agent must not get a replica twice")
+	second := fetch("liar")
+	assert.Len(t, second, 1)
+	assert.Equal(t, first[0].ID, second[0].ID)
+
+	assert.Equal(t, "result accepted", submit("honest-1", first[0].ID, 6))
+	assert.Equal(t, "result accepted", submit("liar", second[0].ID, 7))
+
+	third := fetch("honest-2")
+	assert.Len(t, third, 1, "a tie must be broken by one more agent")
+	assert.Equal(t, "result accepted", submit("honest-2", third[0].ID, 6))
+
+	id, _ := strconv.Atoi(created.ID)
+	user, _ := o.Database.SelectUser(context.Background(), "verifyuser")
+	expr, err := o.Database.GetExpressionByID(context.Background(), id, int(user.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, "completed", expr.Status)
+	assert.Equal(t, 6.0, *expr.Result)
+
+	assert.Equal(t, http.StatusForbidden, agent("GET", "/internal/task", "", "liar").Code)
+	var fleet struct {
+		Agents []struct {
+			ID         string `json:"id"`
+			Quarantine *struct {
+				Reason string `json:"reason"`
+			} `json:"quarantine"`
+		} `json:"agents"`
+	}
+	assert.Equal(t, http.StatusUnauthorized, agent("GET", "/internal/agents", "", "").Code, "agents do not list the fleet")
+	json.NewDecoder(serve(handler, "GET", "/internal/agents", "", "Authorization", "Bearer "+testOperatorToken).Body).Decode(&fleet)
+	for _, a := range fleet.Agents {
+		if a.ID == "liar" {
+			assert.NotNil(t, a.Quarantine)
+		} else {
+			assert.Nil(t, a.Quarantine, a.ID)
+		}
+	}
+
+	// The quarantined agent can neither release itself nor get around it.
+	assert.Equal(t, http.StatusUnauthorized, agent("DELETE", "/internal/agents/liar/quarantine", "", "liar").Code)
+	assert.Equal(t, http.StatusForbidden, agent("POST", "/internal/agents", `{}`, "").Code, "no fresh ID for a quarantined token")
+	assert.Equal(t, http.StatusForbidden, agent("GET", "/internal/task", "", "").Code, "no anonymous leases")
+	assert.Equal(t, http.StatusForbidden, agent("POST", "/internal/task", `{"id":"1","result":6}`, "").Code, "no anonymous results")
+
+	release := serve(handler, "DELETE", "/internal/agents/liar/quarantine", "", "Authorization", "Bearer "+testOperatorToken)
+	assert.Equal(t, http.StatusOK, release.Code)
+	assert.Equal(t, http.StatusNotFound, agent("GET", "/internal/task", "", "liar").Code)
+}
+
+func TestResultNeedsLease(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "leaseuser")
+
+	agent := agentClient(handler)
+	for _, id := range []string{"worker", "idle"} {
+		assert.Equal(t, http.StatusCreated, agent("POST", "/internal/agents", `{"id":"`+id+`"}`, id).Code)
+	}
+	assert.Equal(t, http.StatusCreated, serve(handler, "POST", "/api/v1/calculate", `{"expression":"2*3"}`, "Authorization", "Bearer "+token).Code)
+	var fetched struct {
+		Task orch.Task `json:"task"`
+	}
+	json.NewDecoder(agent("GET", "/internal/task", "", "worker").Body).Decode(&fetched)
+	result := `{"id":"` + fetched.Task.ID + `","result":6}`
+	assert.Equal(t, http.StatusForbidden, agent("POST", "/internal/task", result, "idle").Code, "a task leased by another agent")
+	assert.Equal(t, http.StatusOK, agent("POST", "/internal/task", result, "worker").Code)
+}
@@ -0,0 +1,221 @@
+package tests_integration
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooks(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	o.Config.WebhookSecret = "webhook-secret"
+	o.Config.WebhookAllowPrivate = true
+	o.Config.WebhookBackoff = 1000
+	handler := o.Handler()
+	token := userToken(t, o, "webhookuser")
+
+	type received struct {
+		signature string
+		body      []byte
+	}
+	var (
+		mu       sync.Mutex
+		requests []received
+		failNext = true
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, received{r.Header.Get("X-Webhook-Signature"), body})
+		if failNext {
+			failNext = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(requests)
+	}
+
+	user := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(handler, method, path, body, "Authorization", "Bearer "+token)
+	}
+	complete := func(body string) string {
+		var created struct {
+			ID string `json:"id"`
+		}
+		w := user("POST", "/api/v1/calculate", body)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		json.NewDecoder(w.Body).Decode(&created)
+		var fetched struct {
+			Task orch.Task `json:"task"`
+		}
+		agent := func(method, path, body string) *httptest.ResponseRecorder {
+			return serve(handler, method, path, body, "Authorization", "Bearer "+testAgentToken)
+		}
+		json.NewDecoder(agent("GET", "/internal/task", "").Body).Decode(&fetched)
+		if fetched.Task.Operation == "/" {
+			agent("POST", "/internal/task", `{"id":"`+fetched.Task.ID+`","error":"ErrDivisionByZero"}`)
+		} else {
+			agent("POST", "/internal/task", `{"id":"`+fetched.Task.ID+`","result":6}`)
+		}
+		return created.ID
+	}
+
+	assert.Equal(t, http.StatusUnprocessableEntity, user("POST", "/api/v1/calculate", `{"expression":"1+1","callback_url":"ftp://x"}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, user("PUT", "/api/v1/webhook", `{"url":"not a url"}`).Code)
+	assert.Equal(t, http.StatusOK, user("PUT", "/api/v1/webhook", `{"url":"`+receiver.URL+`"}`).Code)
+	assert.Contains(t, user("GET", "/api/v1/webhook", "").Body.String(), receiver.URL)
+
+	// The default webhook is used; the first attempt fails and is retried
+	// after the backoff.
+	id := complete(`{"expression":"2*3"}`)
+	now := time.Now()
+	o.DeliverWebhooks(now)
+	assert.Equal(t, 1, count())
+	o.DeliverWebhooks(now.Add(500 * time.Millisecond))
+	assert.Equal(t, 1, count(), "retry waits for the backoff")
+	o.DeliverWebhooks(now.Add(1500 * time.Millisecond))
+	assert.Equal(t, 2, count())
+
+	mu.Lock()
+	last := requests[1]
+	mu.Unlock()
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write(last.body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), last.signature)
+	var payload struct {
+		Event      string `json:"event"`
+		Expression struct {
+			ID     string   `json:"id"`
+			Status string   `json:"status"`
+			Result *float64 `json:"result"`
+		} `json:"expression"`
+	}
+	json.Unmarshal(last.body, &payload)
+	assert.Equal(t, "expression.completed", payload.Event)
+	assert.Equal(t, id, payload.Expression.ID)
+	assert.Equal(t, 6.0, *payload.Expression.Result)
+
+	var deliveries struct {
+		Deliveries []struct {
+			ExpressionID int    `json:"expression_id"`
+			Status       string `json:"status"`
+			Attempts     int    `json:"attempts"`
+			ResponseCode int    `json:"response_code"`
+		} `json:"deliveries"`
+	}
+	json.NewDecoder(user("GET", "/api/v1/webhooks/deliveries", "").Body).Decode(&deliveries)
+	assert.NotEmpty(t, deliveries.Deliveries)
+	assert.Equal(t, id, strconv.Itoa(deliveries.Deliveries[0].ExpressionID))
+	assert.Equal(t, "delivered", deliveries.Deliveries[0].Status)
+	assert.Equal(t, 2, deliveries.Deliveries[0].Attempts)
+	assert.Equal(t, http.StatusOK, deliveries.Deliveries[0].ResponseCode)
+
+	// A per-expression callback_url overrides the default, failures are reported too.
+	other := make(chan []byte, 1)
+	otherReceiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		other <- body
+	}))
+	defer otherReceiver.Close()
+	complete(`{"expression":"1/0","callback_url":"` + otherReceiver.URL + `"}`)
+	o.DeliverWebhooks(time.Now())
+	json.Unmarshal(<-other, &payload)
+	assert.Equal(t, "expression.failed", payload.Event)
+	assert.Equal(t, "error", payload.Expression.Status)
+	assert.Equal(t, 2, count())
+}
+
+func TestWebhookSafety(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	token := userToken(t, o, "webhooksafetyuser")
+	user := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(handler, method, path, body, "Authorization", "Bearer "+token)
+	}
+	agent := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(handler, method, path, body, "Authorization", "Bearer "+testAgentToken)
+	}
+	complete := func() {
+		var fetched struct {
+			Task orch.Task `json:"task"`
+		}
+		json.NewDecoder(agent("GET", "/internal/task", "").Body).Decode(&fetched)
+		agent("POST", "/internal/task", `{"id":"`+fetched.Task.ID+`","result":6}`)
+	}
+
+	// Two deliveries only succeed when they are sent at the same time.
+	arrived := make(chan struct{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		deadline := time.After(5 * time.Second)
+		for len(arrived) < 2 {
+			select {
+			case <-deadline:
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer receiver.Close()
+
+	// Without a secret webhooks are disabled.
+	assert.Equal(t, http.StatusServiceUnavailable, user("PUT", "/api/v1/webhook", `{"url":"https://example.com/hook"}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, user("POST", "/api/v1/calculate", `{"expression":"2*3","callback_url":"https://example.com/hook"}`).Code)
+
+	o.Config.WebhookSecret = "webhook-secret"
+	for _, url := range []string{receiver.URL, "http://localhost:8080/", "http://10.0.0.1/", "http://169.254.169.254/latest/meta-data"} {
+		assert.Equal(t, http.StatusUnprocessableEntity, user("PUT", "/api/v1/webhook", `{"url":"`+url+`"}`).Code, url)
+	}
+
+	o.Config.WebhookAllowPrivate = true
+	assert.Equal(t, http.StatusOK, user("PUT", "/api/v1/webhook", `{"url":"`+receiver.URL+`"}`).Code)
+	user("POST", "/api/v1/calculate", `{"expression":"2*3"}`)
+	complete()
+	user("POST", "/api/v1/calculate", `{"expression":"2*4"}`)
+	complete()
+	o.DeliverWebhooks(time.Now())
+	assert.Len(t, arrived, 2)
+
+	// The resolved address is checked again when the delivery is sent.
+	var hits atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits.Add(1) }))
+	defer internal.Close()
+	user("POST", "/api/v1/calculate", `{"expression":"2*5","callback_url":"`+internal.URL+`"}`)
+	complete()
+	o.Config.WebhookAllowPrivate = false
+	o.DeliverWebhooks(time.Now())
+	assert.Zero(t, hits.Load())
+
+	var deliveries struct {
+		Deliveries []struct {
+			Status    string `json:"status"`
+			LastError string `json:"last_error"`
+		} `json:"deliveries"`
+	}
+	json.NewDecoder(user("GET", "/api/v1/webhooks/deliveries", "").Body).Decode(&deliveries)
+	if assert.Len(t, deliveries.Deliveries, 3) {
+		assert.Contains(t, deliveries.Deliveries[0].LastError, "not public")
+		assert.Equal(t, "delivered", deliveries.Deliveries[1].Status)
+		assert.Equal(t, "delivered", deliveries.Deliveries[2].Status)
+	}
+}
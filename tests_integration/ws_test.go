@@ -0,0 +1,126 @@
+package tests_integration
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	orch "github.com/Rail-KH/Final_calc/internal/orchestrator"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocket(t *testing.T) {
+	o := orch.NewOrchestrator()
+	o.Config.AgentTokens = []string{testAgentToken}
+	handler := o.Handler()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	token := userToken(t, o, "wsuser")
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	type message struct {
+		Type      string   `json:"type"`
+		RequestID string   `json:"request_id"`
+		ID        string   `json:"id"`
+		ExprID    string   `json:"expression_id"`
+		TaskID    string   `json:"task_id"`
+		Status    string   `json:"status"`
+		Result    *float64 `json:"result"`
+		Error     string   `json:"error"`
+	}
+	read := func() message {
+		var msg message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	agent := func(method, path, body string) *httptest.ResponseRecorder {
+		return serve(handler, method, path, body, "Authorization", "Bearer "+testAgentToken)
+	}
+
+	conn.WriteJSON(map[string]string{"type": "submit", "request_id": "r1", "expression": "2*3"})
+	msg := read()
+	assert.Equal(t, "submitted", msg.Type)
+	assert.Equal(t, "r1", msg.RequestID)
+	id := msg.ID
+	msg = read()
+	assert.Equal(t, "task_scheduled", msg.Type)
+	assert.Equal(t, id, msg.ExprID)
+
+	var fetched struct {
+		Task orch.Task `json:"task"`
+	}
+	json.NewDecoder(agent("GET", "/internal/task", "").Body).Decode(&fetched)
+	agent("POST", "/internal/task", `{"id":"`+fetched.Task.ID+`","result":6}`)
+	assert.Equal(t, "task_completed", read().Type)
+	msg = read()
+	assert.Equal(t, "done", msg.Type)
+	assert.Equal(t, "completed", msg.Status)
+	assert.Equal(t, 6.0, *msg.Result)
+
+	conn.WriteJSON(map[string]string{"type": "submit", "request_id": "r2", "expression": "2+"})
+	msg = read()
+	assert.Equal(t, "error", msg.Type)
+	assert.Equal(t, "r2", msg.RequestID)
+
+	conn.WriteJSON(map[string]string{"type": "submit", "request_id": "r3", "expression": "1+1"})
+	id = read().ID
+	assert.Equal(t, "task_scheduled", read().Type)
+	conn.WriteJSON(map[string]string{"type": "cancel", "request_id": "r4", "id": id})
+	// The reply and the final event are sent independently, in either order.
+	replies := map[string]message{}
+	for i := 0; i < 2; i++ {
+		msg = read()
+		replies[msg.Type] = msg
+	}
+	assert.Contains(t, replies, "cancelled")
+	assert.Equal(t, "cancelled", replies["done"].Status)
+	assert.Equal(t, http.StatusNotFound, agent("GET", "/internal/task", "").Code)
+
+	conn.WriteJSON(map[string]string{"type": "cancel", "request_id": "r5", "id": id})
+	assert.Equal(t, "error", read().Type)
+
+	// The JWT can also be passed as a query parameter.
+	other, _, err := websocket.DefaultDialer.Dial(wsURL+"?token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.WriteJSON(map[string]string{"type": "subscribe", "id": id})
+	var subscribed, current message
+	other.ReadJSON(&subscribed)
+	other.ReadJSON(&current)
+	assert.Equal(t, "subscribed", subscribed.Type)
+	assert.Equal(t, "done", current.Type)
+	assert.Equal(t, "cancelled", current.Status)
+
+	// An unfinished expression the orchestrator does not compute, e.g. after a
+	// restart, yields its stored state.
+	user, _ := o.Database.SelectUser(context.Background(), "wsuser")
+	orphan, err := o.Database.CreateExpression(context.Background(), int(user.ID), "4+5")
+	assert.NoError(t, err)
+	other.WriteJSON(map[string]string{"type": "subscribe", "id": strconv.Itoa(orphan.ID)})
+	other.ReadJSON(&subscribed)
+	other.ReadJSON(&current)
+	assert.Equal(t, "subscribed", subscribed.Type)
+	assert.Equal(t, "status", current.Type)
+	assert.Equal(t, "pending", current.Status)
+}
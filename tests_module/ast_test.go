@@ -157,3 +157,48 @@ func compareNodes(a, b *calculation.Node) bool {
 		compareNodes(a.Left, b.Left) &&
 		compareNodes(a.Right, b.Right)
 }
+
+func TestCanonical(t *testing.T) {
+	canonical := func(expression string) string {
+		node, err := calculation.ParseAST(expression)
+		if err != nil {
+			t.Fatalf("ParseAST(%q): %v", expression, err)
+		}
+		return calculation.Canonical(node)
+	}
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"2+3", "3+2", true},
+		{"2 * (3+4)", "(4+3)*2.0", true},
+		{"1.50-2", "1.5-2", true},
+		{"2-3", "3-2", false},
+		{"6/3", "3/6", false},
+		{"(1+2)+3", "1+(2+3)", false},
+	}
+	for _, tt := range tests {
+		if got := canonical(tt.a) == canonical(tt.b); got != tt.equal {
+			t.Errorf("Canonical(%q) == Canonical(%q) is %v, want %v", tt.a, tt.b, got, tt.equal)
+		}
+	}
+}
+
+func TestParseASTWithVariables(t *testing.T) {
+	vars := map[string]float64{"x": 3, "rate_2": 0.5}
+	node, err := calculation.ParseASTWithVariables("2*x - -rate_2", vars)
+	if err != nil {
+		t.Fatalf("ParseASTWithVariables: %v", err)
+	}
+	want, _ := calculation.ParseAST("2*3 - -0.5")
+	if !compareNodes(node, want) {
+		t.Errorf("ParseASTWithVariables = %s, want %s", calculation.Canonical(node), calculation.Canonical(want))
+	}
+
+	if _, err := calculation.ParseASTWithVariables("x+y", vars); err == nil {
+		t.Error("expected an error for an unknown variable")
+	}
+	if _, err := calculation.ParseAST("x+1"); err == nil {
+		t.Error("expected an error for a variable without values")
+	}
+}
@@ -48,3 +48,31 @@ func TestVerifyJWTToken(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckAgentToken(t *testing.T) {
+	tokens := []string{"first-token", "second-token"}
+
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{name: "first token", token: "first-token", want: true},
+		{name: "second token", token: "second-token", want: true},
+		{name: "unknown token", token: "other-token", want: false},
+		{name: "prefix of a token", token: "first", want: false},
+		{name: "empty token", token: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := auth.CheckAgentToken(tt.token, tokens); got != tt.want {
+				t.Errorf("CheckAgentToken(%q) = %v, want %v", tt.token, got, tt.want)
+			}
+		})
+	}
+
+	if auth.CheckAgentToken("", nil) {
+		t.Errorf("empty token must be rejected when no tokens are configured")
+	}
+}